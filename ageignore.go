@@ -2,8 +2,10 @@ package agefs
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
@@ -12,6 +14,10 @@ import (
 
 const commentPrefix = "#"
 
+// IgnoreFilename is the name of the files listing patterns of the files
+// not to encrypt. The files themselves are never encrypted.
+const IgnoreFilename = ".ageignore"
+
 func ReadIgnoreFile(filename string) (fn ShouldEncryptFunc, err error) {
 	f, err := os.Open(filename)
 	if err != nil {
@@ -27,30 +33,112 @@ func ReadIgnoreFile(filename string) (fn ShouldEncryptFunc, err error) {
 	return readIgnorePatterns(f)
 }
 
+// ReadIgnoreFiles reads the .ageignore files in rootPath and its
+// subdirectories. As with nested .gitignore files, the patterns in a file
+// are relative to its directory and take precedence over the ones in the
+// parent directories, and the files in excluded directories are not read.
+func ReadIgnoreFiles(rootPath string) (ShouldEncryptFunc, error) {
+	ps, _, err := readIgnoreTree(rootPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newShouldEncryptFunc(ps), nil
+}
+
+// readIgnoreTree reads the .ageignore files in rootPath and its
+// subdirectories. It also returns the contents of the files read by their
+// relative paths, which change whenever the patterns do. decodeName returns the plaintext
+// name of a subdirectory, or false to skip it; nil means names are not
+// encrypted.
+func readIgnoreTree(rootPath string, decodeName func(dir, name string) (string, bool)) (ps []gitignore.Pattern, files map[string][]byte, err error) {
+	if decodeName == nil {
+		decodeName = func(dir, name string) (string, bool) {
+			return name, true
+		}
+	}
+	files = make(map[string][]byte)
+	ps, err = readIgnoreDir(rootPath, nil, nil, files, decodeName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ps, files, nil
+}
+
+func readIgnoreDir(dir string, domain []string, parent []gitignore.Pattern, files map[string][]byte, decodeName func(dir, name string) (string, bool)) ([]gitignore.Pattern, error) {
+	data, err := os.ReadFile(filepath.Join(dir, IgnoreFilename))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ps := parent
+	if data != nil {
+		files[filepath.Join(append(domain[:len(domain):len(domain)], IgnoreFilename)...)] = data
+
+		own, err := parseIgnorePatterns(bytes.NewReader(data), domain)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps[:len(ps):len(ps)], own...)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	m := gitignore.NewMatcher(ps)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name, ok := decodeName(dir, entry.Name())
+		if !ok {
+			continue
+		}
+		subdir := append(domain[:len(domain):len(domain)], name)
+		if m.Match(subdir, true) {
+			continue
+		}
+		if ps, err = readIgnoreDir(filepath.Join(dir, entry.Name()), subdir, ps, files, decodeName); err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
 func readIgnorePatterns(r io.Reader) (fn ShouldEncryptFunc, err error) {
 	var ps []gitignore.Pattern
 	if r != nil {
-		scanner := bufio.NewScanner(r)
-		for scanner.Scan() {
-			s := scanner.Text()
-			if !strings.HasPrefix(s, commentPrefix) && len(strings.TrimSpace(s)) > 0 {
-				ps = append(ps, gitignore.ParsePattern(s, nil))
-			}
-		}
-		if err := scanner.Err(); err != nil {
+		if ps, err = parseIgnorePatterns(r, nil); err != nil {
 			return nil, err
 		}
 	}
+	return newShouldEncryptFunc(ps), nil
+}
 
+func parseIgnorePatterns(r io.Reader, domain []string) ([]gitignore.Pattern, error) {
+	var ps []gitignore.Pattern
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		s := scanner.Text()
+		if !strings.HasPrefix(s, commentPrefix) && len(strings.TrimSpace(s)) > 0 {
+			ps = append(ps, gitignore.ParsePattern(s, domain))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+func newShouldEncryptFunc(ps []gitignore.Pattern) ShouldEncryptFunc {
 	if len(ps) == 0 {
 		return func(relPath string) bool {
 			return true
-		}, nil
+		}
 	}
 
 	m := gitignore.NewMatcher(ps)
 	return func(relPath string) bool {
 		pathComponents := strings.Split(relPath, string(os.PathSeparator))
 		return !m.Match(pathComponents, false)
-	}, nil
+	}
 }
@@ -2,6 +2,8 @@ package agefs
 
 import (
 	_ "embed"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -53,3 +55,48 @@ func TestReadIgnorePatterns(t *testing.T) {
 		}
 	})
 }
+
+func TestReadIgnoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		".ageignore":              "*.pub\nplain/\n",
+		"team/.ageignore":         "*.txt\n!secret.txt\n",
+		"team/keys/.ageignore":    "!*.pub\n",
+		"plain/.ageignore":        "!*\n",
+		"other/nested/.ageignore": "/docs\n",
+	} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fn, err := ReadIgnoreFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		input string
+		want  bool
+	}{
+		{input: "id", want: true},
+		{input: "id.pub", want: false},
+		{input: "notes.txt", want: true},
+		{input: "team/notes.txt", want: false},
+		{input: "team/sub/notes.txt", want: false},
+		{input: "team/secret.txt", want: true},
+		{input: "team/id.pub", want: false},
+		{input: "team/keys/id.pub", want: true},
+		{input: "plain/id", want: false},
+		{input: "other/nested/docs/a", want: false},
+		{input: "other/docs/a", want: true},
+	}
+	for _, tc := range testCases {
+		if got := fn(tc.input); got != tc.want {
+			t.Errorf("result mismatch for input=%s, got=%v, want=%v", tc.input, got, tc.want)
+		}
+	}
+}
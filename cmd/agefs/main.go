@@ -2,11 +2,13 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime/debug"
@@ -33,12 +35,16 @@ func main() {
 				Name:    "mount",
 				Aliases: []string{"m"},
 				Usage:   "mounting agefs filesystem (unmount when exits)",
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:     "identity",
-						Aliases:  []string{"i"},
-						Required: true,
-						Usage:    "identity filename",
+				Flags: append([]cli.Flag{
+					&cli.StringSliceFlag{
+						Name:    "identity",
+						Aliases: []string{"i"},
+						Usage:   "identity filename or directory (can be repeated, required unless --write-only is specified)",
+					},
+					encryptToAllIdentitiesFlag(),
+					&cli.BoolFlag{
+						Name:  "write-only",
+						Usage: "mount without an identity, so that encrypted files can be written to the recipients but not read",
 					},
 					&cli.StringFlag{
 						Name:     "src",
@@ -61,6 +67,32 @@ func main() {
 						Name:  "allow-other",
 						Usage: "mount with -o allowother",
 					},
+					&cli.BoolFlag{
+						Name:  "reload-ageignore",
+						Value: true,
+						Usage: "reload .ageignore files when they are modified while mounted",
+					},
+					&cli.BoolFlag{
+						Name:  "reject-unencrypting-ageignore",
+						Usage: "reject reloading .ageignore files if they would make encrypted files be treated as plaintext, and restore their previous contents",
+					},
+					&cli.BoolFlag{
+						Name:  "refuse-cross-policy-rename",
+						Usage: "fail renames between encrypted and unencrypted paths with EXDEV instead of converting the content",
+					},
+					&cli.BoolFlag{
+						Name:  "encrypt-metadata",
+						Usage: "encrypt symlink targets and user xattr values under encrypted paths",
+					},
+					metadataBackendFlag(),
+					&cli.BoolFlag{
+						Name:  "encrypt-names",
+						Usage: "encrypt file and directory names in the source directory with the key in its .agefs-names file, which is created if missing",
+					},
+					&cli.BoolFlag{
+						Name:  "reverse",
+						Usage: "present the plaintext files in the source directory at encrypted paths as encrypted files, read-only, for backups to untrusted storage",
+					},
 					&cli.BoolFlag{
 						Name:    "quiet",
 						Aliases: []string{"q"},
@@ -71,6 +103,10 @@ func main() {
 						Aliases: []string{"d"},
 						Usage:   "print debugging messages",
 					},
+					&cli.BoolFlag{
+						Name:  "expose-internal-xattrs",
+						Usage: "show and allow modifying the user.agefs_* xattrs on the mount, for debugging",
+					},
 					&cli.StringFlag{
 						Name:  "cpu-profile",
 						Usage: "write cpu profile to this file",
@@ -79,21 +115,148 @@ func main() {
 						Name:  "mem-profile",
 						Usage: "write memory profile to this file",
 					},
-				},
+				}, append(recipientsFlags(), passphraseFlags()...)...),
 				Action: func(cCtx *cli.Context) error {
 					return mountAction(
-						cCtx.String("identity"),
+						identityOptionsFrom(cCtx),
+						cCtx.Bool("write-only"),
+						recipientsOptionsFrom(cCtx),
 						cCtx.String("src"),
 						cCtx.String("mountpoint"),
 						cCtx.Bool("read-only"),
 						cCtx.Bool("allow-other"),
+						cCtx.Bool("reload-ageignore"),
+						cCtx.Bool("reject-unencrypting-ageignore"),
+						cCtx.Bool("refuse-cross-policy-rename"),
+						cCtx.String("metadata-backend"),
+						cCtx.Bool("encrypt-metadata"),
+						cCtx.Bool("encrypt-names"),
+						cCtx.Bool("reverse"),
 						cCtx.Bool("quiet"),
 						cCtx.Bool("debug"),
+						cCtx.Bool("expose-internal-xattrs"),
 						cCtx.String("cpu-profile"),
 						cCtx.String("mem-profile"),
 					)
 				},
 			},
+			{
+				Name:  "rekey",
+				Usage: "re-wrap encrypted files in the source directory to the current recipients",
+				Flags: sourceDirFlags(
+					&cli.BoolFlag{
+						Name:    "dry-run",
+						Aliases: []string{"n"},
+						Usage:   "check files without modifying them",
+					},
+					&cli.BoolFlag{
+						Name:  "reencrypt",
+						Usage: "encrypt files again with new file keys, so that removed recipients cannot decrypt them with the keys of older copies",
+					},
+					&cli.BoolFlag{
+						Name:    "quiet",
+						Aliases: []string{"q"},
+						Usage:   "quiet",
+					},
+				),
+				Action: func(cCtx *cli.Context) error {
+					return rekeyAction(
+						sourceDirOptionsFrom(cCtx),
+						cCtx.Bool("dry-run"),
+						cCtx.Bool("reencrypt"),
+						cCtx.Bool("quiet"),
+					)
+				},
+			},
+			{
+				Name:  "apply-policy",
+				Usage: "encrypt or decrypt files in the source directory to follow the current .ageignore files",
+				Flags: sourceDirFlags(
+					&cli.BoolFlag{
+						Name:    "dry-run",
+						Aliases: []string{"n"},
+						Usage:   "print changes without making them",
+					},
+					&cli.BoolFlag{
+						Name:  "decrypt-age-files",
+						Usage: "decrypt age files at unencrypted paths which are named *.age or armored too, which are otherwise left as they are",
+					},
+					&cli.BoolFlag{
+						Name:    "quiet",
+						Aliases: []string{"q"},
+						Usage:   "quiet",
+					},
+				),
+				Action: func(cCtx *cli.Context) error {
+					return applyPolicyAction(
+						sourceDirOptionsFrom(cCtx),
+						cCtx.Bool("dry-run"),
+						cCtx.Bool("decrypt-age-files"),
+						cCtx.Bool("quiet"),
+					)
+				},
+			},
+			{
+				Name:      "cat",
+				Usage:     "print files in the source directory without mounting",
+				ArgsUsage: "path...",
+				Flags:     sourceDirFlags(),
+				Action: func(cCtx *cli.Context) error {
+					return catAction(
+						sourceDirOptionsFrom(cCtx),
+						cCtx.Args().Slice(),
+					)
+				},
+			},
+			{
+				Name:      "decrypt",
+				Usage:     "write the plaintext of a file in the source directory without mounting",
+				ArgsUsage: "path",
+				Flags: sourceDirFlags(
+					&cli.StringFlag{
+						Name:    "out",
+						Aliases: []string{"o"},
+						Usage:   "output filename (default: standard output)",
+					},
+				),
+				Action: func(cCtx *cli.Context) error {
+					return decryptAction(
+						sourceDirOptionsFrom(cCtx),
+						cCtx.Args().First(),
+						cCtx.String("out"),
+					)
+				},
+			},
+			{
+				Name:      "encrypt",
+				Usage:     "write a file in the source directory without mounting",
+				ArgsUsage: "path",
+				Flags: sourceDirFlags(
+					&cli.StringFlag{
+						Name:  "in",
+						Usage: "input filename (default: standard input)",
+					},
+				),
+				Action: func(cCtx *cli.Context) error {
+					return encryptAction(
+						sourceDirOptionsFrom(cCtx),
+						cCtx.Args().First(),
+						cCtx.String("in"),
+					)
+				},
+			},
+			{
+				Name:      "edit",
+				Usage:     "edit a file in the source directory with $EDITOR without mounting",
+				ArgsUsage: "path",
+				Flags:     sourceDirFlags(),
+				Action: func(cCtx *cli.Context) error {
+					return editAction(
+						sourceDirOptionsFrom(cCtx),
+						cCtx.Args().First(),
+					)
+				},
+			},
 			{
 				Name:    "keygen",
 				Aliases: []string{"k"},
@@ -141,8 +304,9 @@ func Version() string {
 	return info.Main.Version
 }
 
-func mountAction(identityFilename, srcDir, mountpoint string,
-	readonly, allowOther, quiet, debug bool,
+func mountAction(identityOpts identityOptions, writeOnly bool, recipientsOpts recipientsOptions, srcDir, mountpoint string,
+	readonly, allowOther, reloadIgnore, rejectUnencrypting, refuseCrossPolicyRename bool,
+	metadataBackend string, encryptMetadata, encryptNames, reverse, quiet, debug, exposeInternalXattrs bool,
 	cpuProfile, memProfile string) (err error) {
 
 	if cpuProfile != "" {
@@ -171,19 +335,78 @@ func mountAction(identityFilename, srcDir, mountpoint string,
 		}
 	}
 
-	identities, err := ageutil.ParseIdentitiesFile(identityFilename)
+	var identities []age.Identity
+	var identityRecipients []age.Recipient
+	switch {
+	case writeOnly && len(identityOpts.filenames) > 0:
+		return errors.New("--identity must not be specified with --write-only")
+	case !writeOnly && len(identityOpts.filenames) == 0:
+		return errors.New("--identity is required unless --write-only is specified")
+	case !writeOnly:
+		identities, identityRecipients, err = identityOpts.load()
+		if err != nil {
+			fmt.Printf("failed to load private key: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	recipientsFilename := filepath.Join(srcDir, agefs.RecipientsFilename)
+	recipientsFunc, err := agefs.ReadRecipientsFile(recipientsFilename)
+	if err != nil {
+		log.Fatalf("read .agerecipients file (%s): %v\n", recipientsFilename, err)
+	}
+
+	recipients, err := recipientsOpts.parse(identities)
 	if err != nil {
-		fmt.Printf("failed to load private key: %s", err)
-		os.Exit(1)
+		return err
+	}
+	if writeOnly && recipients == nil {
+		return errors.New("--write-only requires --recipient or --recipients-file")
+	}
+	if recipients == nil {
+		recipients = identityRecipients
 	}
 
-	ignoreFilename := filepath.Join(srcDir, ".ageignore")
-	shouldEncrypt, err := agefs.ReadIgnoreFile(ignoreFilename)
+	backend, err := agefs.ParseMetadataBackend(metadataBackend)
 	if err != nil {
-		log.Fatalf("read .ageignore file (%s): %v\n", ignoreFilename, err)
+		return err
 	}
 
-	agefsRoot, err := agefs.NewRoot(srcDir, identities, shouldEncrypt)
+	logger := newLogger(quiet)
+
+	rootOpts := []agefs.RootOption{
+		agefs.WithRecipientsFunc(recipientsFunc),
+		agefs.WithLogger(logger),
+		agefs.WithMetadataBackend(backend),
+	}
+	if reloadIgnore {
+		rootOpts = append(rootOpts, agefs.WithIgnoreFileReload())
+		if rejectUnencrypting {
+			rootOpts = append(rootOpts, agefs.WithRejectUnencrypting())
+		}
+	}
+	if refuseCrossPolicyRename {
+		rootOpts = append(rootOpts, agefs.WithRefuseCrossPolicyRename())
+	}
+	if encryptMetadata {
+		rootOpts = append(rootOpts, agefs.WithMetadataEncryption())
+	}
+	if encryptNames {
+		rootOpts = append(rootOpts, agefs.WithNameEncryption())
+	}
+	if recipients != nil {
+		rootOpts = append(rootOpts, agefs.WithRecipients(recipients))
+	}
+	if exposeInternalXattrs {
+		rootOpts = append(rootOpts, agefs.WithInternalXattrsExposed())
+	}
+	if reverse {
+		rootOpts = append(rootOpts, agefs.WithReverse())
+		readonly = true
+	}
+	// The root reads the .ageignore files itself, since it has to decrypt
+	// the names of the directories to find them if names are encrypted.
+	agefsRoot, err := agefs.NewRoot(srcDir, identities, nil, rootOpts...)
 	if err != nil {
 		log.Fatalf("create agefs root node at (%s): %v\n", srcDir, err)
 	}
@@ -211,9 +434,7 @@ func mountAction(identityFilename, srcDir, mountpoint string,
 	// Leave file permissions on "000" files as-is
 	opts.NullPermissions = true
 	// Enable diagnostics logging
-	if !quiet {
-		opts.Logger = log.New(os.Stderr, "", 0)
-	}
+	opts.Logger = logger
 	server, err := fs.Mount(mountpoint, agefsRoot, opts)
 	if err != nil {
 		log.Fatalf("Mount fail: %v\n", err)
@@ -237,6 +458,413 @@ func mountAction(identityFilename, srcDir, mountpoint string,
 	return nil
 }
 
+// newLogger returns the logger for the messages of the file system and
+// warnings, or nil if quiet is true.
+func newLogger(quiet bool) *log.Logger {
+	if quiet {
+		return nil
+	}
+	return log.New(os.Stderr, "", 0)
+}
+
+// sourceDirFlags returns the flags to open a source directory followed by
+// flags.
+func sourceDirFlags(flags ...cli.Flag) []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringSliceFlag{
+			Name:     "identity",
+			Aliases:  []string{"i"},
+			Required: true,
+			Usage:    "identity filename or directory (can be repeated)",
+		},
+		encryptToAllIdentitiesFlag(),
+		&cli.StringFlag{
+			Name:     "src",
+			Aliases:  []string{"s"},
+			Required: true,
+			Usage:    "source directory",
+		},
+		metadataBackendFlag(),
+	}, append(append(recipientsFlags(), passphraseFlags()...), flags...)...)
+}
+
+// metadataBackendFlag returns the flag to choose where metadata such as
+// decrypted sizes is stored.
+func metadataBackendFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:  "metadata-backend",
+		Value: "auto",
+		Usage: "where to store metadata such as decrypted sizes: xattr, sidecar (the .agefs-metadata file in the source directory) or auto, which uses sidecar if xattrs are not supported or the file exists",
+	}
+}
+
+// encryptToAllIdentitiesFlag returns the flag to encrypt new files to all
+// the identities given with --identity.
+func encryptToAllIdentitiesFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:  "encrypt-to-all-identities",
+		Usage: "encrypt new files to all the identities instead of the ones of the first --identity",
+	}
+}
+
+// identityOptions holds the values of the --identity and
+// --encrypt-to-all-identities flags, and the flags returned by
+// passphraseFlags.
+type identityOptions struct {
+	filenames    []string
+	encryptToAll bool
+	passphrase   passphraseOptions
+}
+
+func identityOptionsFrom(cCtx *cli.Context) identityOptions {
+	return identityOptions{
+		filenames:    cCtx.StringSlice("identity"),
+		encryptToAll: cCtx.Bool("encrypt-to-all-identities"),
+		passphrase:   passphraseOptionsFrom(cCtx),
+	}
+}
+
+// load returns the identities in all the files and directories given with
+// the flags, and the recipients of the ones in the first of them, which new
+// files are encrypted to. The others are only used to decrypt files, such as
+// the ones encrypted to rotated out keys. The recipients are nil if new
+// files are to be encrypted to all the identities.
+func (o identityOptions) load() ([]age.Identity, []age.Recipient, error) {
+	passphrase, err := o.passphrase.source()
+	if err != nil {
+		return nil, nil, err
+	}
+	var identities, first []age.Identity
+	for i, name := range o.filenames {
+		var opts []ageutil.ParseIdentitiesFileOption
+		if passphrase != nil {
+			// Name the file in a directory whose passphrase is asked.
+			opts = append(opts, ageutil.WithPassphraseFor(func(filename string) (string, error) {
+				return passphrase(fmt.Sprintf("Enter passphrase for %q:", filename))
+			}))
+		}
+		ids, err := ageutil.ParseIdentitiesPath(name, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i == 0 {
+			first = ids
+		}
+		identities = append(identities, ids...)
+	}
+	if o.encryptToAll || len(o.filenames) == 1 {
+		return identities, nil, nil
+	}
+	recipients, err := ageutil.IdentitiesToRecipients(first)
+	if err != nil {
+		return nil, nil, err
+	}
+	return identities, recipients, nil
+}
+
+// recipientsFlags returns the flags to choose the recipients of new files.
+func recipientsFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "recipient",
+			Usage: "encrypt new files to this recipient instead of the identity (can be repeated)",
+		},
+		&cli.StringSliceFlag{
+			Name:    "recipients-file",
+			Aliases: []string{"R"},
+			Usage:   "encrypt new files to the recipients listed in this file instead of the identity (can be repeated)",
+		},
+		&cli.BoolFlag{
+			Name:  "allow-foreign-recipients",
+			Usage: "allow recipients which the identity cannot decrypt files for",
+		},
+	}
+}
+
+// recipientsOptions holds the values of the flags returned by
+// recipientsFlags.
+type recipientsOptions struct {
+	recipients      []string
+	recipientsFiles []string
+	allowForeign    bool
+}
+
+func recipientsOptionsFrom(cCtx *cli.Context) recipientsOptions {
+	return recipientsOptions{
+		recipients:      cCtx.StringSlice("recipient"),
+		recipientsFiles: cCtx.StringSlice("recipients-file"),
+		allowForeign:    cCtx.Bool("allow-foreign-recipients"),
+	}
+}
+
+// parse returns the recipients given with the flags, or nil if none are
+// given. Unless allowed, it fails if identities cannot decrypt the files
+// encrypted to them, so that files are not written out of reach by mistake.
+// Write-only mounts have no identities to check.
+func (o recipientsOptions) parse(identities []age.Identity) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, arg := range o.recipients {
+		r, err := ageutil.ParseRecipient(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %v", arg, err)
+		}
+		recipients = append(recipients, r)
+	}
+	for _, name := range o.recipientsFiles {
+		rs, err := ageutil.ParseRecipientsFile(name)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, rs...)
+	}
+	if len(recipients) == 0 {
+		return nil, nil
+	}
+
+	if !o.allowForeign && len(identities) > 0 {
+		if err := ageutil.CheckRecipients(recipients, identities); err != nil {
+			return nil, fmt.Errorf("check recipients: %v (use --allow-foreign-recipients to encrypt to them anyway)", err)
+		}
+	}
+	return recipients, nil
+}
+
+// sourceDirOptions holds the values of the flags returned by
+// sourceDirFlags.
+type sourceDirOptions struct {
+	identity        identityOptions
+	recipients      recipientsOptions
+	srcDir          string
+	metadataBackend string
+}
+
+func sourceDirOptionsFrom(cCtx *cli.Context) sourceDirOptions {
+	return sourceDirOptions{
+		identity:        identityOptionsFrom(cCtx),
+		recipients:      recipientsOptionsFrom(cCtx),
+		srcDir:          cCtx.String("src"),
+		metadataBackend: cCtx.String("metadata-backend"),
+	}
+}
+
+// openSourceDir opens the source directory with the same identity and policy
+// files as mountAction.
+func openSourceDir(o sourceDirOptions) (*agefs.SourceDir, error) {
+	identities, identityRecipients, err := o.identity.load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key: %s", err)
+	}
+
+	shouldEncrypt, err := agefs.ReadIgnoreFiles(o.srcDir)
+	if err != nil {
+		return nil, fmt.Errorf("read .ageignore files (%s): %v", o.srcDir, err)
+	}
+
+	recipientsFilename := filepath.Join(o.srcDir, agefs.RecipientsFilename)
+	recipientsFunc, err := agefs.ReadRecipientsFile(recipientsFilename)
+	if err != nil {
+		return nil, fmt.Errorf("read .agerecipients file (%s): %v", recipientsFilename, err)
+	}
+
+	recipients, err := o.recipients.parse(identities)
+	if err != nil {
+		return nil, err
+	}
+	if recipients == nil {
+		recipients = identityRecipients
+	}
+
+	backend, err := agefs.ParseMetadataBackend(o.metadataBackend)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []agefs.RootOption{
+		agefs.WithRecipientsFunc(recipientsFunc),
+		agefs.WithMetadataBackend(backend),
+	}
+	if recipients != nil {
+		opts = append(opts, agefs.WithRecipients(recipients))
+	}
+	return agefs.NewSourceDir(o.srcDir, identities, shouldEncrypt, opts...)
+}
+
+func rekeyAction(srcOpts sourceDirOptions, dryRun, reencrypt, quiet bool) error {
+	d, err := openSourceDir(srcOpts)
+	if err != nil {
+		return err
+	}
+
+	rekeyed, failures, err := d.Rekey(dryRun, reencrypt)
+	if err != nil {
+		return err
+	}
+	if !quiet {
+		verb := "rekeyed"
+		if dryRun {
+			verb = "would rekey"
+		}
+		for _, p := range rekeyed {
+			fmt.Printf("%s: %s\n", verb, p)
+		}
+	}
+	for _, f := range failures {
+		fmt.Fprintf(os.Stderr, "failed: %s: %v\n", f.Path, f.Err)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d file(s) could not be rekeyed", len(failures))
+	}
+	return nil
+}
+
+func applyPolicyAction(srcOpts sourceDirOptions, dryRun, decryptAgeFiles, quiet bool) error {
+	d, err := openSourceDir(srcOpts)
+	if err != nil {
+		return err
+	}
+
+	changes, failures, err := d.ApplyPolicy(dryRun, decryptAgeFiles)
+	if err != nil {
+		return err
+	}
+	if !quiet {
+		for _, c := range changes {
+			if dryRun {
+				fmt.Printf("would %s: %s\n", c.Action, c.Path)
+			} else {
+				fmt.Printf("%s: %s\n", c.Action, c.Path)
+			}
+		}
+	}
+	for _, f := range failures {
+		fmt.Fprintf(os.Stderr, "failed: %s: %v\n", f.Path, f.Err)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d file(s) could not be changed", len(failures))
+	}
+	return nil
+}
+
+func catAction(srcOpts sourceDirOptions, paths []string) error {
+	if len(paths) == 0 {
+		return errors.New("no path specified")
+	}
+	d, err := openSourceDir(srcOpts)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		data, err := d.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stdout.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decryptAction(srcOpts sourceDirOptions, path, outFilename string) (err error) {
+	if path == "" {
+		return errors.New("no path specified")
+	}
+	d, err := openSourceDir(srcOpts)
+	if err != nil {
+		return err
+	}
+
+	data, err := d.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if outFilename == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(outFilename, data, 0600)
+}
+
+func encryptAction(srcOpts sourceDirOptions, path, inFilename string) error {
+	if path == "" {
+		return errors.New("no path specified")
+	}
+	d, err := openSourceDir(srcOpts)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if inFilename == "" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(inFilename)
+	}
+	if err != nil {
+		return err
+	}
+	return d.WriteFile(path, data, 0600)
+}
+
+// editAction decrypts the file at path to a private temporary file, runs
+// $EDITOR on it, and writes it back if it was modified.
+func editAction(srcOpts sourceDirOptions, path string) (err error) {
+	if path == "" {
+		return errors.New("no path specified")
+	}
+	d, err := openSourceDir(srcOpts)
+	if err != nil {
+		return err
+	}
+
+	data, err := d.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exists := err == nil
+
+	// Keep the plaintext off the disk if possible.
+	tmpRoot := os.TempDir()
+	if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+		tmpRoot = "/dev/shm"
+	}
+	tmpDir, err := os.MkdirTemp(tmpRoot, "agefs-edit-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = multierr.Append(err, os.RemoveAll(tmpDir))
+	}()
+	// Use the same base name so that the editor can tell the file type.
+	tmpFilename := filepath.Join(tmpDir, filepath.Base(path))
+	if err := os.WriteFile(tmpFilename, data, 0600); err != nil {
+		return err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	// $EDITOR may contain arguments, such as "code --wait".
+	cmd := exec.Command("/bin/sh", "-c", editor+` "$1"`, "sh", tmpFilename)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor exited with error, file is not modified: %v", err)
+	}
+
+	edited, err := os.ReadFile(tmpFilename)
+	if err != nil {
+		return err
+	}
+	if exists && bytes.Equal(edited, data) {
+		return nil
+	}
+	return d.WriteFile(path, edited, 0600)
+}
+
 func writeMemProfile(fn string, sigs <-chan os.Signal) {
 	i := 0
 	for range sigs {
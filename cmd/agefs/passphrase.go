@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/urfave/cli/v2"
+)
+
+// passphraseFlags returns the flags to read the passphrases of encrypted
+// identities without a terminal, such as when run by systemd.
+func passphraseFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:  "passphrase-fd",
+			Usage: "read the passphrase of encrypted identities from this file descriptor",
+		},
+		&cli.StringFlag{
+			Name:  "passphrase-file",
+			Usage: "read the passphrase of encrypted identities from this file",
+		},
+		&cli.StringFlag{
+			Name:  "askpass",
+			Usage: "get the passphrase of encrypted identities from the output of this program, which is run with the prompt as its argument",
+		},
+		&cli.StringFlag{
+			Name:  "passphrase-env",
+			Usage: "read the passphrase of encrypted identities from this environment variable (insecure, since the environment can be read by others)",
+		},
+	}
+}
+
+// passphraseOptions holds the values of the flags returned by
+// passphraseFlags.
+type passphraseOptions struct {
+	fd      int
+	hasFD   bool
+	file    string
+	askpass string
+	env     string
+	// logger logs warnings, which are not logged if it is nil as with
+	// --quiet.
+	logger *log.Logger
+}
+
+func passphraseOptionsFrom(cCtx *cli.Context) passphraseOptions {
+	return passphraseOptions{
+		fd:      cCtx.Int("passphrase-fd"),
+		hasFD:   cCtx.IsSet("passphrase-fd"),
+		file:    cCtx.String("passphrase-file"),
+		askpass: cCtx.String("askpass"),
+		env:     cCtx.String("passphrase-env"),
+		logger:  newLogger(cCtx.Bool("quiet")),
+	}
+}
+
+// passphraseSource is where the passphrases of encrypted identities are
+// read from.
+type passphraseSource int
+
+const (
+	passphraseFromTerminal passphraseSource = iota
+	passphraseFromFD
+	passphraseFromFile
+	passphraseFromAskpass
+	passphraseFromEnv
+)
+
+// selectSource returns the source given with the flags. The terminal is
+// used only if none of them is given, even --passphrase-fd=0, and giving
+// more than one of them is an error.
+func (o passphraseOptions) selectSource() (passphraseSource, error) {
+	var sources []passphraseSource
+	for src, set := range map[passphraseSource]bool{
+		passphraseFromFD:      o.hasFD,
+		passphraseFromFile:    o.file != "",
+		passphraseFromAskpass: o.askpass != "",
+		passphraseFromEnv:     o.env != "",
+	} {
+		if set {
+			sources = append(sources, src)
+		}
+	}
+	switch len(sources) {
+	case 0:
+		return passphraseFromTerminal, nil
+	case 1:
+		return sources[0], nil
+	default:
+		return 0, errors.New("only one of --passphrase-fd, --passphrase-file, --askpass and --passphrase-env can be specified")
+	}
+}
+
+// source returns a function to get the passphrase asked with a prompt, or
+// nil if the passphrase is to be read from the terminal. The passphrase
+// given with a file descriptor, file or environment variable is read once,
+// and used for all the encrypted identities.
+func (o passphraseOptions) source() (func(prompt string) (string, error), error) {
+	src, err := o.selectSource()
+	if err != nil {
+		return nil, err
+	}
+	switch src {
+	case passphraseFromFD:
+		return readPassphraseOnce(func() ([]byte, error) {
+			f := os.NewFile(uintptr(o.fd), "passphrase-fd")
+			if f == nil {
+				return nil, fmt.Errorf("invalid passphrase file descriptor: %d", o.fd)
+			}
+			defer f.Close()
+			return io.ReadAll(f)
+		}), nil
+	case passphraseFromFile:
+		return readPassphraseOnce(func() ([]byte, error) {
+			return os.ReadFile(o.file)
+		}), nil
+	case passphraseFromAskpass:
+		return func(prompt string) (string, error) {
+			cmd := exec.Command(o.askpass, prompt)
+			cmd.Stderr = os.Stderr
+			out, err := cmd.Output()
+			if err != nil {
+				return "", fmt.Errorf("run askpass program %q: %v", o.askpass, err)
+			}
+			return trimPassphrase(out), nil
+		}, nil
+	case passphraseFromEnv:
+		pass, ok := os.LookupEnv(o.env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", o.env)
+		}
+		if o.logger != nil {
+			o.logger.Printf("warning: reading the passphrase from the environment variable %s is insecure, consider --passphrase-fd or --passphrase-file instead", o.env)
+		}
+		// Keep the passphrase from the programs run by us.
+		os.Unsetenv(o.env)
+		return func(string) (string, error) { return pass, nil }, nil
+	}
+	return nil, nil
+}
+
+// readPassphraseOnce returns a function returning the passphrase read with
+// read when it is called for the first time.
+func readPassphraseOnce(read func() ([]byte, error)) func(prompt string) (string, error) {
+	var (
+		once sync.Once
+		pass string
+		err  error
+	)
+	return func(string) (string, error) {
+		once.Do(func() {
+			var b []byte
+			if b, err = read(); err != nil {
+				err = fmt.Errorf("could not read passphrase: %v", err)
+				return
+			}
+			pass = trimPassphrase(b)
+		})
+		return pass, err
+	}
+}
+
+// trimPassphrase returns b without the trailing newline.
+func trimPassphrase(b []byte) string {
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	return strings.TrimSuffix(string(b), "\r")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPassphraseSelectSource(t *testing.T) {
+	testCases := []struct {
+		opts    passphraseOptions
+		want    passphraseSource
+		wantErr bool
+	}{
+		{opts: passphraseOptions{}, want: passphraseFromTerminal},
+		{opts: passphraseOptions{hasFD: true}, want: passphraseFromFD},
+		{opts: passphraseOptions{fd: 3}, want: passphraseFromTerminal},
+		{opts: passphraseOptions{file: "pass.txt"}, want: passphraseFromFile},
+		{opts: passphraseOptions{askpass: "askpass"}, want: passphraseFromAskpass},
+		{opts: passphraseOptions{env: "PASS"}, want: passphraseFromEnv},
+		{opts: passphraseOptions{hasFD: true, file: "pass.txt"}, wantErr: true},
+		{opts: passphraseOptions{askpass: "askpass", env: "PASS"}, wantErr: true},
+		{opts: passphraseOptions{hasFD: true, file: "pass.txt", askpass: "askpass", env: "PASS"}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := tc.opts.selectSource()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("error mismatch for %+v, got=%v, wantErr=%v", tc.opts, err, tc.wantErr)
+			continue
+		}
+		if err == nil && got != tc.want {
+			t.Errorf("source mismatch for %+v, got=%d, want=%d", tc.opts, got, tc.want)
+		}
+	}
+	if _, err := (passphraseOptions{hasFD: true, env: "PASS"}).source(); err == nil {
+		t.Error("got no error for conflicting sources")
+	}
+}
+
+func TestPassphraseSource(t *testing.T) {
+	dir := t.TempDir()
+	passFilename := filepath.Join(dir, "pass.txt")
+	if err := os.WriteFile(passFilename, []byte("pa ss\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The askpass program echoes the prompt, so that it can be checked.
+	askpass := filepath.Join(dir, "askpass.sh")
+	if err := os.WriteFile(askpass, []byte("#!/bin/sh\necho \"$1\"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AGEFS_TEST_PASSPHRASE", "pa ss")
+
+	testCases := []struct {
+		opts passphraseOptions
+		want string
+	}{
+		{opts: passphraseOptions{file: passFilename}, want: "pa ss"},
+		{opts: passphraseOptions{askpass: askpass}, want: "prompt for key"},
+		{opts: passphraseOptions{env: "AGEFS_TEST_PASSPHRASE"}, want: "pa ss"},
+	}
+	for _, tc := range testCases {
+		passphrase, err := tc.opts.source()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := passphrase("prompt for key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("passphrase mismatch for %+v, got=%q, want=%q", tc.opts, got, tc.want)
+		}
+	}
+	if _, ok := os.LookupEnv("AGEFS_TEST_PASSPHRASE"); ok {
+		t.Error("environment variable must be unset after reading the passphrase")
+	}
+
+	if passphrase, err := (passphraseOptions{}).source(); err != nil || passphrase != nil {
+		t.Errorf("terminal must be used without flags, got err=%v", err)
+	}
+}
+
+func TestPassphraseEnvWarning(t *testing.T) {
+	for _, quiet := range []bool{false, true} {
+		t.Setenv("AGEFS_TEST_PASSPHRASE", "pass")
+		var buf bytes.Buffer
+		opts := passphraseOptions{env: "AGEFS_TEST_PASSPHRASE"}
+		if !quiet {
+			opts.logger = log.New(&buf, "", 0)
+		}
+		if _, err := opts.source(); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(buf.String(), "insecure"); got == quiet {
+			t.Errorf("warning mismatch, quiet=%v, got=%q", quiet, buf.String())
+		}
+	}
+}
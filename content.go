@@ -0,0 +1,699 @@
+package agefs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"filippo.io/age"
+	"go.uber.org/multierr"
+	"golang.org/x/sys/unix"
+)
+
+// fileContent is the plaintext of an encrypted file shared by all handles
+// opened for the same inode. It is created on the first open and written
+// back on the last release.
+//
+// Lock order is ageFSFile.mu, ageFSNode.mu and then fileContent.mu.
+type fileContent struct {
+	mu      sync.Mutex
+	node    *ageFSNode
+	handles map[*ageFSFile]struct{}
+
+	// fd is opened read-only for decrypting regardless of the flags of the
+	// handles. If the file cannot be read, such as a file with mode 0200,
+	// it is a duplicate of the file descriptor of a write-only handle and
+	// readable is false.
+	fd       int
+	readable bool
+	reader   plaintextReader
+	buf      []byte
+	dirty    bool
+
+	// stale is set if the file descriptors could not all be reopened after
+	// the file was replaced, so that I/O fails instead of going to the
+	// unlinked file.
+	stale bool
+}
+
+// acquireContent registers f as a handle of the shared content of n,
+// creating it from the file at path if f is the first one.
+func (n *ageFSNode) acquireContent(f *ageFSFile, path string) (*fileContent, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.content == nil {
+		readable := true
+		fd, err := syscall.Open(path, os.O_RDONLY, 0)
+		if err == syscall.EACCES && f.flags&syscall.O_ACCMODE == syscall.O_WRONLY {
+			readable = false
+			fd, err = unix.FcntlInt(uintptr(f.fd), unix.F_DUPFD_CLOEXEC, 0)
+		}
+		if err != nil {
+			return nil, err
+		}
+		n.content = &fileContent{
+			node:     n,
+			handles:  make(map[*ageFSFile]struct{}),
+			fd:       fd,
+			readable: readable,
+		}
+	}
+	c := n.content
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.readable && f.flags&syscall.O_ACCMODE != syscall.O_WRONLY {
+		// A handle which can read the file has been opened since.
+		if err := unix.Dup3(f.fd, c.fd, syscall.O_CLOEXEC); err != nil {
+			return nil, err
+		}
+		c.readable = true
+	}
+	c.handles[f] = struct{}{}
+	return c, nil
+}
+
+// releaseContent unregisters f, and writes back and drops the shared
+// content if f was the last handle.
+func (n *ageFSNode) releaseContent(f *ageFSFile) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	c := n.content
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.handles, f)
+	if len(c.handles) > 0 {
+		return nil
+	}
+	n.content = nil
+	err := c.save()
+	return multierr.Append(err, syscall.Close(c.fd))
+}
+
+// openContentSize returns the plaintext size of the shared content of n.
+// ok is false if no handle is open for n.
+func (n *ageFSNode) openContentSize() (sz int64, ok bool, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	c := n.content
+	if c == nil {
+		return 0, false, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sz, err = c.attrSize()
+	return sz, true, err
+}
+
+// All methods below must be called with c.mu held.
+
+// check returns an error if the file descriptors of the content are stale.
+func (c *fileContent) check() error {
+	if c.stale {
+		return syscall.EIO
+	}
+	return nil
+}
+
+// locked reports whether any handle holds or is taking a lock on its file
+// descriptor, which would be lost if the file were replaced.
+func (c *fileContent) locked() bool {
+	for f := range c.handles {
+		if f.locks.pending > 0 || f.locks.flock || f.locks.ofd {
+			return true
+		}
+	}
+	return false
+}
+
+// newReader returns a reader of the plaintext in the file. Only an empty
+// file can be read if c.fd cannot.
+func (c *fileContent) newReader() (plaintextReader, error) {
+	if !c.readable {
+		st := syscall.Stat_t{}
+		if err := syscall.Fstat(c.fd, &st); err != nil {
+			return nil, err
+		}
+		if st.Size > 0 {
+			return nil, syscall.EACCES
+		}
+		return bytes.NewReader(nil), nil
+	}
+	return newPlaintextReader(c.fd, c.node.root().identities)
+}
+
+func (c *fileContent) readAt(p []byte, off int64) (int, error) {
+	if err := c.check(); err != nil {
+		return 0, err
+	}
+	if c.buf != nil {
+		if off >= int64(len(c.buf)) {
+			return 0, io.EOF
+		}
+		return copy(p, c.buf[off:]), nil
+	}
+
+	if c.reader == nil {
+		r, err := c.newReader()
+		if err != nil {
+			return 0, err
+		}
+		c.reader = r
+	}
+	return c.reader.ReadAt(p, off)
+}
+
+func (c *fileContent) size() (int64, error) {
+	if err := c.check(); err != nil {
+		return 0, err
+	}
+	if c.buf != nil {
+		return int64(len(c.buf)), nil
+	}
+
+	if c.reader == nil {
+		r, err := c.newReader()
+		if err != nil {
+			return 0, err
+		}
+		c.reader = r
+	}
+	return c.reader.Size(), nil
+}
+
+// attrSize is like size but avoids decrypting if the plaintext has not been
+// read yet, in the same way as ageFSNode.Lookup.
+func (c *fileContent) attrSize() (int64, error) {
+	if err := c.check(); err != nil {
+		return 0, err
+	}
+	if c.buf != nil || c.reader != nil {
+		return c.size()
+	}
+
+	var sz uint64
+	if err := c.node.fixAttrSize(c.node.relPath(), c.node.path(), &sz); err != nil {
+		return 0, err
+	}
+	return int64(sz), nil
+}
+
+// load decrypts the whole plaintext into c.buf so that it can be modified.
+func (c *fileContent) load() error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	if c.buf != nil {
+		return nil
+	}
+
+	r := c.reader
+	if r == nil {
+		var err error
+		if r, err = c.newReader(); err != nil {
+			return err
+		}
+	}
+	data := make([]byte, r.Size())
+	if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+		return err
+	}
+	c.buf = data
+	c.reader = nil
+	return nil
+}
+
+func (c *fileContent) write(data []byte, off int64) error {
+	if err := c.load(); err != nil {
+		return err
+	}
+
+	end := int(off) + len(data)
+	if len(c.buf) < end {
+		newBuf := make([]byte, end)
+		copy(newBuf, c.buf)
+		c.buf = newBuf
+	}
+	copy(c.buf[off:end], data)
+	c.dirty = true
+	return nil
+}
+
+// append writes data at the end of the plaintext, which may have been
+// extended by other handles since the kernel computed the write offset.
+func (c *fileContent) append(data []byte) error {
+	if err := c.load(); err != nil {
+		return err
+	}
+	return c.write(data, int64(len(c.buf)))
+}
+
+func (c *fileContent) truncate(sz uint64) error {
+	if err := c.check(); err != nil {
+		return err
+	}
+	if sz > 0 {
+		if err := c.load(); err != nil {
+			return err
+		}
+	}
+
+	newBuf := make([]byte, sz)
+	copy(newBuf, c.buf)
+	c.buf = newBuf
+	c.reader = nil
+	c.dirty = true
+	return nil
+}
+
+// extend grows the plaintext to sz bytes with zeros if it is shorter.
+func (c *fileContent) extend(sz uint64) error {
+	if err := c.load(); err != nil {
+		return err
+	}
+	if uint64(len(c.buf)) >= sz {
+		return nil
+	}
+	return c.truncate(sz)
+}
+
+// zeroRange fills sz bytes from off with zeros. The plaintext is extended
+// if needed unless keepSize is true.
+func (c *fileContent) zeroRange(off, sz uint64, keepSize bool) error {
+	if !keepSize {
+		if err := c.extend(off + sz); err != nil {
+			return err
+		}
+	} else if err := c.load(); err != nil {
+		return err
+	}
+
+	end := off + sz
+	if end > uint64(len(c.buf)) {
+		end = uint64(len(c.buf))
+	}
+	for i := off; i < end; i++ {
+		c.buf[i] = 0
+	}
+	c.dirty = true
+	return nil
+}
+
+// seekDataHole implements SEEK_DATA and SEEK_HOLE of lseek(2) on the
+// plaintext. Encrypted files cannot be sparse, so the only hole is the
+// implicit one at the end of the file.
+func (c *fileContent) seekDataHole(off uint64, whence uint32) (uint64, error) {
+	sz, err := c.size()
+	if err != nil {
+		return 0, err
+	}
+	if off >= uint64(sz) {
+		return 0, syscall.ENXIO
+	}
+	switch whence {
+	case unix.SEEK_DATA:
+		return off, nil
+	case unix.SEEK_HOLE:
+		return uint64(sz), nil
+	default:
+		return 0, syscall.EINVAL
+	}
+}
+
+// flush saves the content and then drops the plaintext buffer.
+func (c *fileContent) flush() error {
+	if err := c.save(); err != nil {
+		return err
+	}
+	c.buf = nil
+	return nil
+}
+
+func (c *fileContent) save() (err error) {
+	if err := c.check(); err != nil {
+		return err
+	}
+	if !c.dirty {
+		return nil
+	}
+
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(c.fd, &st); err != nil {
+		return err
+	}
+	switch {
+	case st.Nlink == 0:
+		// The file was unlinked while it was open, so there is nothing to
+		// write back to.
+	case st.Nlink > 1:
+		// Replacing the file would detach it from its other hard links.
+		err = c.writeEncryptedInPlace()
+	case c.locked():
+		// Replacing the file would drop the locks on it, which belong to
+		// the open file descriptions of the handles.
+		err = c.writeEncryptedInPlace()
+	default:
+		err = c.writeEncryptedAndReplace(&st)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.dirty = false
+	return nil
+}
+
+// writeEncryptedAndReplace writes the encrypted content to a temporary file
+// in the same directory and renames it over the original file, so that the
+// original is left intact if anything fails before the rename. The file
+// descriptors of the content and its handles are reopened afterwards to
+// refer to the new file, and the content is marked stale if that fails.
+func (c *fileContent) writeEncryptedAndReplace(st *syscall.Stat_t) error {
+	path := c.node.path()
+	newSt, err := c.node.root().replaceFile(path, c.fd, st, func(tmp *os.File) error {
+		bw := bufio.NewWriter(tmp)
+		if err := encryptTo(bw, c.buf, c.node.root().recipientsFor(c.node.relPath())); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		return c.node.root().setXattrDecryptedSize(tmp.Name(), uint64(len(c.buf)))
+	})
+	if newSt != nil {
+		c.node.root().replacedIno(c.node.EmbeddedInode(), st, newSt)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.reader = nil
+	fdFlags := os.O_RDONLY
+	if !c.readable {
+		fdFlags = os.O_WRONLY
+	}
+	if err := reopenFd(c.fd, path, fdFlags); err != nil {
+		c.stale = true
+		return err
+	}
+	for f := range c.handles {
+		if err := reopenFd(f.fd, path, f.flags); err != nil {
+			c.stale = true
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceFile replaces the file at path, which is opened as fd and has the
+// status st, with a temporary file in the same directory written by write.
+// The mode, owner and extended attributes of the file are carried over to
+// the new one. It returns the status of the new file, which is non-nil once
+// the file has been replaced even if err is not nil.
+func (r *ageFSRoot) replaceFile(path string, fd int, st *syscall.Stat_t, write func(tmp *os.File) error) (newSt *syscall.Stat_t, err error) {
+	dir := filepath.Dir(path)
+	tmp, err := createTemp(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil && newSt == nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err := tmp.Chmod(os.FileMode(st.Mode & 07777)); err != nil {
+		return nil, err
+	}
+	var tmpSt syscall.Stat_t
+	if err := syscall.Fstat(int(tmp.Fd()), &tmpSt); err != nil {
+		return nil, err
+	}
+	if tmpSt.Uid != st.Uid || tmpSt.Gid != st.Gid {
+		if err := tmp.Chown(int(st.Uid), int(st.Gid)); err != nil {
+			return nil, err
+		}
+		// chown(2) clears set-user-ID and set-group-ID bits.
+		if err := tmp.Chmod(os.FileMode(st.Mode & 07777)); err != nil {
+			return nil, err
+		}
+	}
+	if err := copyXattrs(int(tmp.Fd()), fd); err != nil {
+		return nil, err
+	}
+
+	if err := write(tmp); err != nil {
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return nil, err
+	}
+	if err := syscall.Fstat(int(tmp.Fd()), &tmpSt); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	// The file has been replaced even if the rest fails.
+	err = syncDir(dir)
+	if st.Nlink <= 1 {
+		err = multierr.Append(err, r.metadata().forget(st))
+	}
+	return &tmpSt, err
+}
+
+// createTemp creates a temporary file in the directory of the file at path.
+func createTemp(path string) (*os.File, error) {
+	dir, base := filepath.Split(path)
+	// Keep the temporary name within NAME_MAX for long names.
+	if len(base) > 200 {
+		base = base[:200]
+	}
+	return os.CreateTemp(dir, "."+base+".agefs-tmp-*")
+}
+
+// writeEncryptedInPlace overwrites the file through a new file descriptor.
+// It is used only where the file cannot be replaced. The ciphertext is
+// written to an unlinked temporary file first, so that the file is left
+// intact if encrypting fails, and then copied over the file. The copy is
+// not atomic, so a crash during it leaves the file corrupted, and processes
+// reading the source directory directly may see a mix of the old and new
+// ciphertext.
+func (c *fileContent) writeEncryptedInPlace() (err error) {
+	path := c.node.path()
+	tmp, err := createTemp(path)
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	if err := os.Remove(tmp.Name()); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(tmp)
+	if err := encryptTo(bw, c.buf, c.node.root().recipientsFor(c.node.relPath())); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	fd, err := syscall.Open(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = multierr.Append(err, syscall.Close(fd))
+	}()
+	if _, err := io.Copy(&fdWriter{fd: fd}, tmp); err != nil {
+		return err
+	}
+	if err := syscall.Ftruncate(fd, size); err != nil {
+		return err
+	}
+	if err := c.node.root().setXattrDecryptedSize(path, uint64(len(c.buf))); err != nil {
+		return err
+	}
+	c.reader = nil
+	return syscall.Fsync(fd)
+}
+
+// policyDiffers reports whether moving the file at path with the status st
+// from oldRelPath to newRelPath changes whether its content, or the content
+// of any regular file under it if it is a directory, should be encrypted.
+func (r *ageFSRoot) policyDiffers(path string, st *syscall.Stat_t, oldRelPath, newRelPath string) (bool, error) {
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		return r.shouldEncrypt(oldRelPath) != r.shouldEncrypt(newRelPath), nil
+	case syscall.S_IFDIR:
+	default:
+		return false, nil
+	}
+
+	errDiffers := errors.New("policy differs")
+	err := filepath.WalkDir(path, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		rel, ok := r.decodeRelPath(path, rel)
+		if !ok {
+			return nil
+		}
+		if r.shouldEncrypt(filepath.Join(oldRelPath, rel)) != r.shouldEncrypt(filepath.Join(newRelPath, rel)) {
+			return errDiffers
+		}
+		return nil
+	})
+	if err == errDiffers {
+		return true, nil
+	}
+	return false, err
+}
+
+// convertFile writes the content of the regular file at oldPath with the
+// status st to newPath, decrypting or encrypting it to follow the policy for
+// newRelPath. It returns the status of the new file, which is non-nil once
+// the file at newPath has been replaced even if err is not nil.
+func (r *ageFSRoot) convertFile(oldPath, oldRelPath, newPath, newRelPath string, st *syscall.Stat_t) (newSt *syscall.Stat_t, err error) {
+	f, err := os.Open(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = multierr.Append(err, f.Close())
+	}()
+
+	data, err := r.readContent(f, oldRelPath)
+	if err != nil {
+		return nil, err
+	}
+	return r.replaceFile(newPath, int(f.Fd()), st, func(tmp *os.File) error {
+		return r.writeContent(tmp, newRelPath, data)
+	})
+}
+
+// readContent returns the content of the file f at relPath, decrypting it
+// if the policy says so.
+func (r *ageFSRoot) readContent(f *os.File, relPath string) ([]byte, error) {
+	if !r.shouldEncrypt(relPath) {
+		return io.ReadAll(f)
+	}
+	return r.decryptFile(f)
+}
+
+// writeContent writes data to the file f at relPath, encrypting it if the
+// policy says so.
+func (r *ageFSRoot) writeContent(f *os.File, relPath string, data []byte) error {
+	if !r.shouldEncrypt(relPath) {
+		_, err := f.Write(data)
+		return err
+	}
+	return r.encryptToFile(f, relPath, data)
+}
+
+// decryptFile returns the plaintext of the encrypted file f.
+func (r *ageFSRoot) decryptFile(f *os.File) ([]byte, error) {
+	pr, err := newPlaintextReader(int(f.Fd()), r.identities)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, pr.Size())
+	if _, err := pr.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// encryptToFile writes data encrypted to the recipients for relPath to f,
+// and records the plaintext size in the xattr of f.
+func (r *ageFSRoot) encryptToFile(f *os.File, relPath string, data []byte) error {
+	bw := bufio.NewWriter(f)
+	if err := encryptTo(bw, data, r.recipientsFor(relPath)); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return r.setXattrDecryptedSize(f.Name(), uint64(len(data)))
+}
+
+func encryptTo(out io.Writer, plaintext []byte, recipients []age.Recipient) error {
+	w, err := age.Encrypt(out, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// reopenFd opens path again and puts the new file at the descriptor number
+// fd, so that holders of fd see the file that replaced the old one.
+func reopenFd(fd int, path string, flags int) error {
+	newFd, err := syscall.Open(path, flags&^(syscall.O_CREAT|syscall.O_EXCL|syscall.O_TRUNC), 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(newFd)
+	return unix.Dup3(newFd, fd, syscall.O_CLOEXEC)
+}
+
+// fdWriter writes to a file descriptor with pwrite(2) starting from
+// offset 0, regardless of the offset of the file descriptor.
+type fdWriter struct {
+	fd  int
+	off int64
+}
+
+func (w *fdWriter) Write(p []byte) (int, error) {
+	var n int
+	for n < len(p) {
+		nn, err := syscall.Pwrite(w.fd, p[n:], w.off)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return n, err
+		}
+		n += nn
+		w.off += int64(nn)
+	}
+	return n, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	return multierr.Append(err, d.Close())
+}
@@ -0,0 +1,657 @@
+package agefs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+func TestFileContentAllocate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		off, sz uint64
+		mode    uint32
+		want    []byte
+		wantErr error
+	}{
+		{name: "extend", off: 4, sz: 4, mode: 0, want: []byte("hello\x00\x00\x00")},
+		{name: "allocateWithin", off: 0, sz: 2, mode: 0, want: []byte("hello")},
+		{name: "keepSize", off: 4, sz: 4, mode: unix.FALLOC_FL_KEEP_SIZE, want: []byte("hello")},
+		{name: "punchHole", off: 1, sz: 10, mode: unix.FALLOC_FL_PUNCH_HOLE | unix.FALLOC_FL_KEEP_SIZE, want: []byte("h\x00\x00\x00\x00")},
+		{name: "punchHoleWithoutKeepSize", off: 1, sz: 2, mode: unix.FALLOC_FL_PUNCH_HOLE, wantErr: syscall.EOPNOTSUPP},
+		{name: "zeroRange", off: 3, sz: 4, mode: unix.FALLOC_FL_ZERO_RANGE, want: []byte("hel\x00\x00\x00\x00")},
+		{name: "zeroRangeKeepSize", off: 3, sz: 4, mode: unix.FALLOC_FL_ZERO_RANGE | unix.FALLOC_FL_KEEP_SIZE, want: []byte("hel\x00\x00")},
+		{name: "collapseRange", off: 0, sz: 1, mode: unix.FALLOC_FL_COLLAPSE_RANGE, wantErr: syscall.EOPNOTSUPP},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &fileContent{buf: []byte("hello")}
+			err := c.allocate(tc.off, tc.sz, tc.mode)
+			if err != tc.wantErr {
+				t.Fatalf("error mismatch, got=%v, want=%v", err, tc.wantErr)
+			}
+			if err == nil && !bytes.Equal(c.buf, tc.want) {
+				t.Errorf("content mismatch, got=%q, want=%q", c.buf, tc.want)
+			}
+		})
+	}
+}
+
+func TestFileContentSeekDataHole(t *testing.T) {
+	c := &fileContent{buf: []byte("hello")}
+	testCases := []struct {
+		off     uint64
+		whence  uint32
+		want    uint64
+		wantErr error
+	}{
+		{off: 0, whence: unix.SEEK_DATA, want: 0},
+		{off: 3, whence: unix.SEEK_DATA, want: 3},
+		{off: 5, whence: unix.SEEK_DATA, wantErr: syscall.ENXIO},
+		{off: 0, whence: unix.SEEK_HOLE, want: 5},
+		{off: 4, whence: unix.SEEK_HOLE, want: 5},
+		{off: 6, whence: unix.SEEK_HOLE, wantErr: syscall.ENXIO},
+	}
+	for _, tc := range testCases {
+		got, err := c.seekDataHole(tc.off, tc.whence)
+		if err != tc.wantErr {
+			t.Errorf("error mismatch for off=%d, whence=%d, got=%v, want=%v", tc.off, tc.whence, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("result mismatch for off=%d, whence=%d, got=%d, want=%d", tc.off, tc.whence, got, tc.want)
+		}
+	}
+}
+
+func TestPolicyDiffers(t *testing.T) {
+	shouldEncrypt, err := readIgnorePatterns(strings.NewReader("plain/\n*.pub\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &ageFSRoot{}
+	r.policy.Store(&shouldEncrypt)
+
+	dir := t.TempDir()
+	for _, name := range []string{"keys/id", "keys/id.pub", "pubs/id.pub"} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		oldRelPath, newRelPath string
+		want                   bool
+	}{
+		{oldRelPath: "keys/id", newRelPath: "secrets/id", want: false},
+		{oldRelPath: "keys/id", newRelPath: "plain/id", want: true},
+		{oldRelPath: "keys/id.pub", newRelPath: "plain/id.pub", want: false},
+		{oldRelPath: "keys", newRelPath: "secrets", want: false},
+		{oldRelPath: "keys", newRelPath: "plain/keys", want: true},
+		{oldRelPath: "pubs", newRelPath: "plain/pubs", want: false},
+	}
+	for _, tc := range testCases {
+		p := filepath.Join(dir, tc.oldRelPath)
+		var st syscall.Stat_t
+		if err := syscall.Lstat(p, &st); err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.policyDiffers(p, &st, tc.oldRelPath, tc.newRelPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("result mismatch for %s -> %s, got=%v, want=%v", tc.oldRelPath, tc.newRelPath, got, tc.want)
+		}
+	}
+}
+
+// openTestFile opens the file named name in the root directory of the file
+// system rooted at root without mounting it.
+func openTestFile(t *testing.T, root fs.InodeEmbedder, name string, flags uint32) *ageFSFile {
+	t.Helper()
+	ctx := context.Background()
+	child := root.EmbeddedInode().GetChild(name)
+	if child == nil {
+		var out fuse.EntryOut
+		var errno syscall.Errno
+		child, errno = root.(*ageFSNode).Lookup(ctx, name, &out)
+		if errno != 0 {
+			t.Fatalf("lookup %s: %v", name, errno)
+		}
+		// The bridge of a mounted file system would add the child.
+		root.EmbeddedInode().AddChild(name, child, false)
+	}
+	fh, _, errno := child.Operations().(*ageFSNode).Open(ctx, flags)
+	if errno != 0 {
+		t.Fatalf("open %s: %v", name, errno)
+	}
+	return fh.(*ageFSFile)
+}
+
+func TestFileContentSaveKeepsLocks(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.txt")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewRoot(dir, []age.Identity{id}, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := context.Background()
+	f := openTestFile(t, root, "secret.txt", syscall.O_RDWR)
+	defer f.Release(ctx)
+
+	ino := func() uint64 {
+		var st syscall.Stat_t
+		if err := syscall.Stat(path, &st); err != nil {
+			t.Fatal(err)
+		}
+		return st.Ino
+	}
+	// lockedByOthers reports whether the lock on the file is seen by
+	// another open file description.
+	lockedByOthers := func() bool {
+		fd, err := syscall.Open(path, syscall.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Close(fd)
+		err = syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != nil && err != syscall.EWOULDBLOCK {
+			t.Fatal(err)
+		}
+		return err == syscall.EWOULDBLOCK
+	}
+
+	lk := &fuse.FileLock{Typ: syscall.F_WRLCK}
+	if errno := f.Setlk(ctx, 0, lk, fuse.FUSE_LK_FLOCK); errno != 0 {
+		t.Fatal(errno)
+	}
+	oldIno := ino()
+	if _, errno := f.Write(ctx, []byte("locked"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno := f.Flush(ctx); errno != 0 {
+		t.Fatal(errno)
+	}
+	if ino() != oldIno {
+		t.Error("locked file must be written in place")
+	}
+	if !lockedByOthers() {
+		t.Error("lock must be kept after save")
+	}
+
+	lk.Typ = syscall.F_UNLCK
+	if errno := f.Setlk(ctx, 0, lk, fuse.FUSE_LK_FLOCK); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, errno := f.Write(ctx, []byte("unlocked"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno := f.Flush(ctx); errno != 0 {
+		t.Fatal(errno)
+	}
+	if ino() == oldIno {
+		t.Error("unlocked file must be replaced")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := readAndDecryptFile(bytes.NewReader(data), []age.Identity{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != "unlocked" {
+		t.Errorf("content mismatch, got=%q, want=%q", decrypted, "unlocked")
+	}
+}
+
+func TestFileContentShared(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.txt")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewRoot(dir, []age.Identity{id}, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := context.Background()
+	f1 := openTestFile(t, root, "secret.txt", syscall.O_RDWR)
+	f2 := openTestFile(t, root, "secret.txt", syscall.O_RDONLY)
+	if f1.content != f2.content {
+		t.Fatal("handles of the same inode must share the content")
+	}
+
+	if _, errno := f1.Write(ctx, []byte("shared"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	res, errno := f2.Read(ctx, make([]byte, 100), 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if got, _ := res.Bytes(nil); string(got) != "shared" {
+		t.Errorf("content read through another handle mismatch, got=%q, want=%q", got, "shared")
+	}
+
+	readDisk := func() string {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) == 0 {
+			return ""
+		}
+		decrypted, err := readAndDecryptFile(bytes.NewReader(data), []age.Identity{id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(decrypted)
+	}
+	if errno := f1.Release(ctx); errno != 0 {
+		t.Fatal(errno)
+	}
+	if got := readDisk(); got != "" {
+		t.Errorf("content must be written back on the last release, got=%q", got)
+	}
+	if errno := f2.Release(ctx); errno != 0 {
+		t.Fatal(errno)
+	}
+	if got := readDisk(); got != "shared" {
+		t.Errorf("content on disk mismatch, got=%q, want=%q", got, "shared")
+	}
+}
+
+func TestReplaceFile(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	d, err := NewSourceDir(dir, []age.Identity{id}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := d.root
+
+	path := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+	hasXattrs := syscall.Setxattr(path, "user.test", []byte("value"), 0) == nil
+	chowned := os.Chown(path, 1, 1) == nil
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		t.Fatal(err)
+	}
+	newSt, err := r.replaceFile(path, int(f.Fd()), &st, func(tmp *os.File) error {
+		_, err := tmp.WriteString("new")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got syscall.Stat_t
+	if err := syscall.Stat(path, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Ino != newSt.Ino || got.Ino == st.Ino {
+		t.Errorf("file must be replaced, got ino=%d, old=%d, new=%d", got.Ino, st.Ino, newSt.Ino)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "new" {
+		t.Errorf("content mismatch, got=%q, err=%v", data, err)
+	}
+	if got.Mode&07777 != 0640 {
+		t.Errorf("mode mismatch, got=%o, want=%o", got.Mode&07777, 0640)
+	}
+	if chowned && (got.Uid != 1 || got.Gid != 1) {
+		t.Errorf("owner mismatch, got=%d:%d, want=1:1", got.Uid, got.Gid)
+	}
+	if hasXattrs {
+		if value, err := lgetxattr(path, "user.test"); err != nil || string(value) != "value" {
+			t.Errorf("xattr mismatch, got=%q, err=%v", value, err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".agefs-tmp-") {
+			t.Errorf("temporary file %s must not be left", e.Name())
+		}
+	}
+}
+
+func TestFileContentWriteOnlyFile(t *testing.T) {
+	if os.Geteuid() == 0 {
+		// Root can read a file with mode 0200, so run the test as nobody.
+		runAsNobody(t, "TestFileContentWriteOnlyFile")
+		return
+	}
+
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	root, err := NewRoot(dir, []age.Identity{id}, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := context.Background()
+
+	var out fuse.EntryOut
+	ch, fh, _, errno := root.(*ageFSNode).Create(ctx, "secret.txt", syscall.O_WRONLY, 0200, &out)
+	if errno != 0 {
+		t.Fatalf("create with mode 0200: %v", errno)
+	}
+	root.EmbeddedInode().AddChild("secret.txt", ch, false)
+	f := fh.(*ageFSFile)
+	if _, errno := f.Write(ctx, []byte("write-only"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno := f.Release(ctx); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	f = openTestFile(t, root, "secret.txt", syscall.O_WRONLY|syscall.O_TRUNC)
+	if _, errno := f.Write(ctx, []byte("again"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno := f.Release(ctx); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	f = openTestFile(t, root, "secret.txt", syscall.O_WRONLY)
+	if _, errno := f.Write(ctx, []byte("x"), 1); errno != syscall.EACCES {
+		t.Errorf("partial write to an unreadable file: got=%v, want=%v", errno, syscall.EACCES)
+	}
+	if errno := f.Release(ctx); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	path := filepath.Join(dir, "secret.txt")
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := readAndDecryptFile(bytes.NewReader(data), []age.Identity{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != "again" {
+		t.Errorf("content mismatch, got=%q, want=%q", decrypted, "again")
+	}
+}
+
+// runAsNobody runs the test named name in a copy of the test binary as the
+// user nobody, for tests of permissions which root bypasses.
+func runAsNobody(t *testing.T, name string) {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Dir(dir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "agefs.test")
+	if err := os.WriteFile(bin, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(bin, "-test.run=^"+name+"$", "-test.v")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "TMPDIR="+dir)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: 65534, Gid: 65534},
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s as nobody: %v\n%s", name, err, output)
+	}
+	if !bytes.Contains(output, []byte("--- PASS: "+name)) {
+		t.Skipf("%s did not run as nobody:\n%s", name, output)
+	}
+}
+
+func TestFileContentAppend(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.txt")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewRoot(dir, []age.Identity{id}, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := context.Background()
+
+	read := func(f *ageFSFile) string {
+		t.Helper()
+		res, errno := f.Read(ctx, make([]byte, 100), 0)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		got, _ := res.Bytes(nil)
+		return string(got)
+	}
+	write := func(f *ageFSFile, data string, off int64) {
+		t.Helper()
+		if n, errno := f.Write(ctx, []byte(data), off); errno != 0 || n != uint32(len(data)) {
+			t.Fatalf("write %q at %d: n=%d, %v", data, off, n, errno)
+		}
+	}
+
+	// The offsets are ignored as the kernel may pass the size it has
+	// cached.
+	appender := openTestFile(t, root, "secret.txt", syscall.O_WRONLY|syscall.O_APPEND)
+	write(appender, "hello", 0)
+	write(appender, ",", 0)
+	other := openTestFile(t, root, "secret.txt", syscall.O_RDWR)
+	if got := read(other); got != "hello," {
+		t.Errorf("content after appending through a handle mismatch, got=%q, want=%q", got, "hello,")
+	}
+
+	write(other, " world", 6)
+	write(appender, "!", 6)
+	if got := read(other); got != "hello, world!" {
+		t.Errorf("content after appending to content extended by another handle mismatch, got=%q, want=%q", got, "hello, world!")
+	}
+
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: 5}}
+	if errno := other.Setattr(ctx, in, &fuse.AttrOut{}); errno != 0 {
+		t.Fatal(errno)
+	}
+	write(appender, "?", 13)
+	if got := read(other); got != "hello?" {
+		t.Errorf("content after appending to truncated content mismatch, got=%q, want=%q", got, "hello?")
+	}
+
+	for _, f := range []*ageFSFile{appender, other} {
+		if errno := f.Release(ctx); errno != 0 {
+			t.Fatal(errno)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := readAndDecryptFile(bytes.NewReader(data), []age.Identity{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != "hello?" {
+		t.Errorf("content on disk mismatch, got=%q, want=%q", decrypted, "hello?")
+	}
+}
+
+func TestFileGetattrPlaintextSize(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "secret.txt"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewRoot(dir, []age.Identity{id}, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := context.Background()
+	f := openTestFile(t, root, "secret.txt", syscall.O_RDWR)
+	defer f.Release(ctx)
+
+	size := func() uint64 {
+		t.Helper()
+		var out fuse.AttrOut
+		if errno := f.Getattr(ctx, &out); errno != 0 {
+			t.Fatal(errno)
+		}
+		return out.Size
+	}
+
+	if _, errno := f.Write(ctx, []byte("hello world"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if got := size(); got != 11 {
+		t.Errorf("size after an unsaved write mismatch, got=%d, want=11", got)
+	}
+
+	var out fuse.AttrOut
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: 5}}
+	if errno := f.Setattr(ctx, in, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if out.Size != 5 {
+		t.Errorf("size returned by ftruncate mismatch, got=%d, want=5", out.Size)
+	}
+	if _, errno := f.Write(ctx, []byte("!"), 5); errno != 0 {
+		t.Fatal(errno)
+	}
+	in.Size = 20
+	if errno := f.Setattr(ctx, in, &out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, errno := f.Write(ctx, []byte("?"), 20); errno != 0 {
+		t.Fatal(errno)
+	}
+	if got := size(); got != 21 {
+		t.Errorf("size after ftruncate and an unsaved write mismatch, got=%d, want=21", got)
+	}
+	if !f.content.dirty {
+		t.Error("content must be unsaved")
+	}
+}
+
+func TestFileContentSaveHardLinked(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.txt")
+	var encrypted bytes.Buffer
+	if err := encryptTo(&encrypted, bytes.Repeat([]byte("long content "), 100), []age.Recipient{id.Recipient()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, encrypted.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.txt")
+	if err := os.Link(path, link); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewRoot(dir, []age.Identity{id}, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := context.Background()
+
+	f := openTestFile(t, root, "secret.txt", syscall.O_RDWR|syscall.O_TRUNC)
+	if _, errno := f.Write(ctx, []byte("short"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno := f.Release(ctx); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	// The file is overwritten in place to keep the other link.
+	data, err := os.ReadFile(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := readAndDecryptFile(bytes.NewReader(data), []age.Identity{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != "short" {
+		t.Errorf("content through the other link mismatch, got=%q, want=%q", decrypted, "short")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("temporary file left in the directory: %v", entries)
+	}
+}
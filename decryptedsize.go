@@ -0,0 +1,183 @@
+package agefs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hnakamur/agefs/internal/ageutil"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/sys/unix"
+)
+
+// xattrNameSizeKey is the metadata of the source directory holding the key to
+// authenticate the decrypted sizes with, encrypted with age.
+const xattrNameSizeKey = "user.agefs_size_key"
+
+const sizeKeySize = 32
+
+// sizeMACKey returns the key to authenticate the decrypted sizes with,
+// creating it if the source directory has none. It returns nil if the key
+// can be neither read nor created, in which case the sizes are recorded
+// without authentication and never trusted.
+func (r *ageFSRoot) sizeMACKey() []byte {
+	r.sizeKeyOnce.Do(func() {
+		key, err := r.loadSizeKey()
+		if err != nil {
+			// A write-only file system cannot decrypt the key
+			// created by others, which is not worth logging.
+			if !r.writeOnly() {
+				r.logf("load key for decrypted sizes: %v", err)
+			}
+			return
+		}
+		macKey := make([]byte, sha256.Size)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("agefs decrypted size")), macKey); err != nil {
+			r.logf("derive key for decrypted sizes: %v", err)
+			return
+		}
+		r.sizeKey = macKey
+	})
+	return r.sizeKey
+}
+
+func (r *ageFSRoot) loadSizeKey() ([]byte, error) {
+	for {
+		value, err := r.metadata().get(r.Path, xattrNameSizeKey)
+		if err == nil {
+			key, err := readAndDecryptFile(bytes.NewReader(value), r.identities)
+			if err != nil {
+				return nil, err
+			}
+			if len(key) != sizeKeySize {
+				return nil, errors.New("invalid key size")
+			}
+			return key, nil
+		}
+		if !errors.Is(err, syscall.ENODATA) {
+			return nil, err
+		}
+
+		key := make([]byte, sizeKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := encryptTo(&buf, key, r.recipientsFor("")); err != nil {
+			return nil, err
+		}
+		err = r.metadata().set(r.Path, xattrNameSizeKey, buf.Bytes(), unix.XATTR_CREATE)
+		if err == nil {
+			return key, nil
+		}
+		if !errors.Is(err, syscall.EEXIST) {
+			return nil, err
+		}
+		// Another process has created the key in the meantime.
+	}
+}
+
+// rekeySizeKey re-wraps the key for the decrypted sizes to the recipients
+// of the source directory.
+func (r *ageFSRoot) rekeySizeKey(dryRun bool) error {
+	value, err := r.metadata().get(r.Path, xattrNameSizeKey)
+	if err != nil {
+		if errors.Is(err, syscall.ENODATA) {
+			return nil
+		}
+		return err
+	}
+	var buf bytes.Buffer
+	if err := ageutil.Rekey(&buf, bytes.NewReader(value), r.identities, r.recipientsFor("")); err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+	return r.metadata().set(r.Path, xattrNameSizeKey, buf.Bytes(), unix.XATTR_REPLACE)
+}
+
+// decryptedSizeMAC authenticates the plaintext size of a file together with
+// the size and modification time of its ciphertext, so that the plaintext
+// size is not trusted once the ciphertext is modified outside of agefs.
+func decryptedSizeMAC(key []byte, plainSize uint64, st *syscall.Stat_t) string {
+	h := hmac.New(sha256.New, key)
+	fmt.Fprintf(h, "%d:%d:%d", plainSize, st.Size, st.Mtim.Nano())
+	return base64.RawStdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// getXattrDecryptedSize returns the plaintext size recorded for the
+// encrypted file at path. ok is false if no size is recorded, or if the
+// recorded size is not authentic or is stale.
+func (r *ageFSRoot) getXattrDecryptedSize(path string) (sz uint64, ok bool, err error) {
+	value, err := r.metadata().get(path, xattrNameDecryptedSize)
+	if err != nil {
+		if errors.Is(err, syscall.ENODATA) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	// The value is the plaintext size, the ciphertext size, the
+	// modification time in nanoseconds and the MAC separated by colons.
+	fields := strings.Split(string(value), ":")
+	if len(fields) != 4 {
+		return 0, false, nil
+	}
+	sz, err = strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, false, nil
+	}
+
+	key := r.sizeMACKey()
+	if key == nil {
+		return 0, false, nil
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, false, err
+	}
+	if !hmac.Equal([]byte(fields[3]), []byte(decryptedSizeMAC(key, sz, &st))) {
+		return 0, false, nil
+	}
+	return sz, true, nil
+}
+
+// setXattrDecryptedSize records sz as the plaintext size of the encrypted
+// file at path, which must not be modified afterwards.
+func (r *ageFSRoot) setXattrDecryptedSize(path string, sz uint64) error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return err
+	}
+	var mac string
+	if key := r.sizeMACKey(); key != nil {
+		mac = decryptedSizeMAC(key, sz, &st)
+	}
+	value := fmt.Sprintf("%d:%d:%d:%s", sz, st.Size, st.Mtim.Nano(), mac)
+	return r.metadata().set(path, xattrNameDecryptedSize, []byte(value), 0)
+}
+
+func (r *ageFSRoot) hasXattrDecryptedSize(path string) (bool, error) {
+	if _, err := r.metadata().get(path, xattrNameDecryptedSize); err != nil {
+		if errors.Is(err, syscall.ENODATA) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *ageFSRoot) removeXattrDecryptedSize(path string) error {
+	if err := r.metadata().remove(path, xattrNameDecryptedSize); err != nil && !errors.Is(err, syscall.ENODATA) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package agefs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestXattrDecryptedSize(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	d, err := NewSourceDir(dir, []age.Identity{id}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := d.root
+
+	path := filepath.Join(dir, "secret.txt")
+	if err := os.WriteFile(path, []byte("ciphertext"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := r.getXattrDecryptedSize(path); err != nil || ok {
+		t.Fatalf("missing size must not be trusted, got ok=%v, err=%v", ok, err)
+	}
+	if err := r.setXattrDecryptedSize(path, 5); err != nil {
+		t.Fatal(err)
+	}
+	if sz, ok, err := r.getXattrDecryptedSize(path); err != nil || !ok || sz != 5 {
+		t.Fatalf("size mismatch, got=%d, ok=%v, err=%v", sz, ok, err)
+	}
+
+	value, err := lgetxattr(path, xattrNameDecryptedSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name  string
+		value string
+	}{
+		{name: "legacy", value: "5"},
+		{name: "forged", value: "6" + strings.TrimPrefix(string(value), "5")},
+		{name: "unauthenticated", value: string(value[:strings.LastIndexByte(string(value), ':')+1])},
+	}
+	for _, tc := range testCases {
+		if err := syscall.Setxattr(path, xattrNameDecryptedSize, []byte(tc.value), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok, err := r.getXattrDecryptedSize(path); err != nil || ok {
+			t.Errorf("%s size must not be trusted, got ok=%v, err=%v", tc.name, ok, err)
+		}
+	}
+
+	// Modifying the ciphertext outside of agefs makes the size stale.
+	if err := syscall.Setxattr(path, xattrNameDecryptedSize, value, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("modified ciphertext"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := r.getXattrDecryptedSize(path); err != nil || ok {
+		t.Errorf("stale size must not be trusted, got ok=%v, err=%v", ok, err)
+	}
+
+	// Another root reads the same key.
+	d2, err := NewSourceDir(dir, []age.Identity{id}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.setXattrDecryptedSize(path, 7); err != nil {
+		t.Fatal(err)
+	}
+	if sz, ok, err := d2.root.getXattrDecryptedSize(path); err != nil || !ok || sz != 7 {
+		t.Errorf("size mismatch with another root, got=%d, ok=%v, err=%v", sz, ok, err)
+	}
+}
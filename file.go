@@ -9,8 +9,6 @@ import (
 	"bytes"
 	"context"
 	"io"
-	"os"
-	"path/filepath"
 	"sync"
 	"syscall"
 
@@ -18,17 +16,36 @@ import (
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hnakamur/agefs/internal/ageutil"
+	"go.uber.org/multierr"
 	"golang.org/x/sys/unix"
 )
 
 type ageFSFile struct {
 	mu            sync.Mutex
 	fd            int
+	flags         int
 	relPath       string
 	node          *ageFSNode
 	shouldEncrypt bool
-	buf           []byte
-	dirty         bool
+	content       *fileContent
+	// policy is the policy of the root shouldEncrypt was last checked
+	// against.
+	policy *ShouldEncryptFunc
+
+	// locks records the locks on fd of an encrypted file, which keep the
+	// file from being replaced on save. It is guarded by content.mu.
+	locks fileLocks
+}
+
+// fileLocks records the locks taken on a file descriptor.
+type fileLocks struct {
+	// pending is the number of lock requests in progress.
+	pending int
+	// flock is set while a flock(2) lock is held.
+	flock bool
+	// ofd is set once an open file description lock is taken, until the
+	// whole file is unlocked.
+	ofd bool
 }
 
 var _ = (fs.FileHandle)((*ageFSFile)(nil))
@@ -48,18 +65,43 @@ var _ = (fs.FileAllocater)((*ageFSFile)(nil))
 
 const xattrNameDecryptedSize = "user.agefs_decrypted_size"
 
-func newFile(fd int, relPath string, node *ageFSNode) *ageFSFile {
-	shouldEncrypt := node.root().shouldEncrypt(relPath)
-	return &ageFSFile{
+// newFile returns a file handle for fd, which is the file opened with flags
+// for node. The handle of an encrypted file shares its plaintext with the
+// other handles of node.
+func newFile(fd int, flags uint32, relPath string, node *ageFSNode) (*ageFSFile, error) {
+	policy := node.root().policy.Load()
+	f := &ageFSFile{
 		fd:            fd,
+		flags:         int(flags),
 		relPath:       relPath,
 		node:          node,
-		shouldEncrypt: shouldEncrypt,
+		shouldEncrypt: shouldEncryptWith(*policy, relPath),
+		policy:        policy,
+	}
+	if f.shouldEncrypt {
+		c, err := node.acquireContent(f, node.root().backingPath(relPath))
+		if err != nil {
+			return nil, err
+		}
+		f.content = c
 	}
+	return f, nil
 }
 
-func (f *ageFSFile) path() string {
-	return filepath.Join(f.node.RootData.Path, f.relPath)
+// checkPolicy returns ESTALE if the .ageignore files have been reloaded
+// since f was opened and the file should now be encrypted if it was not or
+// vice versa, since writing through f would mix plaintext and ciphertext.
+// f.mu must be held.
+func (f *ageFSFile) checkPolicy() error {
+	policy := f.node.root().policy.Load()
+	if policy == f.policy {
+		return nil
+	}
+	if shouldEncryptWith(*policy, f.node.relPath()) != f.shouldEncrypt {
+		return syscall.ESTALE
+	}
+	f.policy = policy
+	return nil
 }
 
 func (f *ageFSFile) Read(ctx context.Context, buf []byte, off int64) (res fuse.ReadResult, errno syscall.Errno) {
@@ -71,32 +113,20 @@ func (f *ageFSFile) Read(ctx context.Context, buf []byte, off int64) (res fuse.R
 		return r, fs.OK
 	}
 
-	if err := f.readAndDecryptIfNeeded(f.fd); err != nil {
+	f.content.mu.Lock()
+	defer f.content.mu.Unlock()
+	n, err := f.content.readAt(buf, off)
+	if err != nil && err != io.EOF {
 		return nil, fs.ToErrno(err)
 	}
-	end := int(off) + len(buf)
-	if end > len(f.buf) {
-		end = len(f.buf)
-	}
-	data := f.buf[off:end]
-	return fuse.ReadResultData(data), fs.OK
+	return fuse.ReadResultData(buf[:n]), fs.OK
 }
 
-func (f *ageFSFile) readAndDecryptIfNeeded(fd int) error {
-	if f.buf != nil {
-		return nil
-	}
-
-	file := os.NewFile(uintptr(fd), f.path())
-	data, err := readAndDecryptFile(file, f.node.root().identities)
-	if err != nil {
-		return err
+func readAndDecryptFile(file io.Reader, identities []age.Identity) ([]byte, error) {
+	if len(identities) == 0 {
+		// The file system is write-only.
+		return nil, syscall.EACCES
 	}
-	f.buf = data
-	return nil
-}
-
-func readAndDecryptFile(file *os.File, identities []age.Identity) ([]byte, error) {
 	br := bufio.NewReader(file)
 	ew, err := ageutil.NewDecryptingReader(identities, br)
 	if err != nil {
@@ -112,22 +142,27 @@ func readAndDecryptFile(file *os.File, identities []age.Identity) ([]byte, error
 func (f *ageFSFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if err := f.checkPolicy(); err != nil {
+		return 0, fs.ToErrno(err)
+	}
 
 	if !f.shouldEncrypt {
+		// pwrite(2) ignores off and appends if f.fd is opened with O_APPEND.
 		n, err := syscall.Pwrite(f.fd, data, off)
 		return uint32(n), fs.ToErrno(err)
 	}
 
-	end := int(off) + len(data)
-	f.dirty = true
-	if f.buf == nil {
-		f.buf = make([]byte, end)
-	} else if len(f.buf) < end {
-		newBuf := make([]byte, end)
-		copy(newBuf, f.buf)
-		f.buf = newBuf
+	f.content.mu.Lock()
+	defer f.content.mu.Unlock()
+	var err error
+	if f.flags&syscall.O_APPEND != 0 {
+		err = f.content.append(data)
+	} else {
+		err = f.content.write(data, off)
+	}
+	if err != nil {
+		return 0, fs.ToErrno(err)
 	}
-	copy(f.buf[off:end], data)
 	return uint32(len(data)), fs.OK
 }
 
@@ -135,7 +170,12 @@ func (f *ageFSFile) Release(ctx context.Context) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	if f.fd != -1 {
-		err := syscall.Close(f.fd)
+		var err error
+		if f.content != nil {
+			err = f.node.releaseContent(f)
+			f.content = nil
+		}
+		err = multierr.Append(err, syscall.Close(f.fd))
 		f.fd = -1
 		return fs.ToErrno(err)
 	}
@@ -154,54 +194,44 @@ func (f *ageFSFile) Flush(ctx context.Context) syscall.Errno {
 		return fs.ToErrno(err)
 	}
 
-	if err := f.saveEncrypted(ctx); err != nil {
-		return fs.ToErrno(err)
+	if f.content != nil {
+		f.content.mu.Lock()
+		err = f.content.flush()
+		f.content.mu.Unlock()
+		if err != nil {
+			syscall.Close(newFd)
+			return fs.ToErrno(err)
+		}
 	}
-	f.buf = nil
 
 	err = syscall.Close(newFd)
-	return fs.ToErrno(err)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+
+	if f.flags&syscall.O_ACCMODE != syscall.O_RDONLY && f.node.root().reloadIgnore && isIgnoreFile(f.relPath) {
+		return fs.ToErrno(f.node.root().reloadIgnoreFiles())
+	}
+	return fs.OK
 }
 
 func (f *ageFSFile) Fsync(ctx context.Context, flags uint32) (errno syscall.Errno) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	if err := f.saveEncrypted(ctx); err != nil {
-		return fs.ToErrno(err)
+	if f.content != nil {
+		f.content.mu.Lock()
+		err := f.content.save()
+		f.content.mu.Unlock()
+		if err != nil {
+			return fs.ToErrno(err)
+		}
 	}
 
 	r := fs.ToErrno(syscall.Fsync(f.fd))
 	return r
 }
 
-func (f *ageFSFile) saveEncrypted(ctx context.Context) (err error) {
-	if !f.dirty {
-		return nil
-	}
-
-	path := f.path()
-	file := os.NewFile(uintptr(f.fd), path)
-
-	w, err := age.Encrypt(file, f.node.root().recipients...)
-	if err != nil {
-		return err
-	}
-	if _, err := w.Write(f.buf); err != nil {
-		return err
-	}
-	if err := w.Close(); err != nil {
-		return err
-	}
-
-	if err := setXattrDecryptedSize(path, uint64(len(f.buf))); err != nil {
-		return err
-	}
-
-	f.dirty = false
-	return nil
-}
-
 const (
 	_OFD_GETLK  = 36
 	_OFD_SETLK  = 37
@@ -229,6 +259,25 @@ func (f *ageFSFile) Setlkw(ctx context.Context, owner uint64, lk *fuse.FileLock,
 func (f *ageFSFile) setLock(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, blocking bool) (errno syscall.Errno) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if f.content != nil {
+		// Keep the file from being replaced while the lock is being taken,
+		// without holding content.mu while blocking.
+		f.content.mu.Lock()
+		if err := f.content.check(); err != nil {
+			f.content.mu.Unlock()
+			return fs.ToErrno(err)
+		}
+		f.locks.pending++
+		f.content.mu.Unlock()
+		defer func() {
+			f.content.mu.Lock()
+			f.locks.pending--
+			if errno == 0 {
+				f.locks.update(lk, flags)
+			}
+			f.content.mu.Unlock()
+		}()
+	}
 	if (flags & fuse.FUSE_LK_FLOCK) != 0 {
 		var op int
 		switch lk.Typ {
@@ -258,6 +307,21 @@ func (f *ageFSFile) setLock(ctx context.Context, owner uint64, lk *fuse.FileLock
 	}
 }
 
+// maxLockEnd is the end of a lock range extending to the end of the file.
+const maxLockEnd = (1 << 63) - 1
+
+// update records the lock request lk which has succeeded.
+func (l *fileLocks) update(lk *fuse.FileLock, flags uint32) {
+	locked := lk.Typ != syscall.F_UNLCK
+	if (flags & fuse.FUSE_LK_FLOCK) != 0 {
+		l.flock = locked
+	} else if locked {
+		l.ofd = true
+	} else if lk.Start == 0 && lk.End == maxLockEnd {
+		l.ofd = false
+	}
+}
+
 func (f *ageFSFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
 	if errno := f.setAttr(ctx, in); errno != 0 {
 		return errno
@@ -269,6 +333,14 @@ func (f *ageFSFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.A
 func (f *ageFSFile) setAttr(ctx context.Context, in *fuse.SetAttrIn) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if f.content != nil {
+		f.content.mu.Lock()
+		err := f.content.check()
+		f.content.mu.Unlock()
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+	}
 	var errno syscall.Errno
 	if mode, ok := in.GetMode(); ok {
 		errno = fs.ToErrno(syscall.Fchmod(f.fd, mode))
@@ -314,36 +386,22 @@ func (f *ageFSFile) setAttr(ctx context.Context, in *fuse.SetAttrIn) syscall.Err
 	}
 
 	if sz, ok := in.GetSize(); ok {
+		if err := f.checkPolicy(); err != nil {
+			return fs.ToErrno(err)
+		}
 		if f.shouldEncrypt {
-			if sz > 0 && f.buf == nil {
-				fd, err := syscall.Open(f.path(), os.O_RDONLY, 0)
-				if err != nil {
-					return fs.ToErrno(err)
-				}
-				if err := f.readAndDecryptIfNeeded(fd); err != nil {
-					syscall.Close(fd)
-					return fs.ToErrno(err)
-				}
-				if err := syscall.Close(fd); err != nil {
-					return fs.ToErrno(err)
-				}
+			// Encrypted files cannot be sparse, so growing one fills the
+			// new range with zeros.
+			f.content.mu.Lock()
+			err := f.content.truncate(sz)
+			if err == nil {
+				err = f.content.save()
 			}
-
-			errno = fs.ToErrno(syscall.Ftruncate(f.fd, 0))
-			if errno != 0 {
-				return errno
-			}
-
-			newBuf := make([]byte, sz)
-			copy(newBuf, f.buf)
-			f.buf = newBuf
-			f.dirty = true
-			if err := f.saveEncrypted(ctx); err != nil {
+			f.content.mu.Unlock()
+			if err != nil {
 				return fs.ToErrno(err)
 			}
 		} else {
-			// TODO: truncate f.buf and write it to file instead of call fruncate if encrypted and sz < len(f.buf)
-			// TODO: what to do if sz > len(f.buf)? we cannot make a hole for encrypted file
 			errno = fs.ToErrno(syscall.Ftruncate(f.fd, int64(sz)))
 			if errno != 0 {
 				return errno
@@ -362,6 +420,18 @@ func (f *ageFSFile) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Errno
 		return fs.ToErrno(err)
 	}
 	a.FromStat(&st)
+	// The backing file may have been replaced on save.
+	a.Ino = f.node.StableAttr().Ino
+
+	if f.shouldEncrypt {
+		f.content.mu.Lock()
+		sz, err := f.content.attrSize()
+		f.content.mu.Unlock()
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+		a.Size = uint64(sz)
+	}
 
 	return fs.OK
 }
@@ -369,6 +439,12 @@ func (f *ageFSFile) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Errno
 func (f *ageFSFile) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if f.shouldEncrypt {
+		f.content.mu.Lock()
+		defer f.content.mu.Unlock()
+		n, err := f.content.seekDataHole(off, whence)
+		return n, fs.ToErrno(err)
+	}
 	n, err := unix.Seek(f.fd, int64(off), int(whence))
 	return uint64(n), fs.ToErrno(err)
 }
@@ -6,16 +6,27 @@ package agefs
 
 import (
 	"context"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
 )
 
 func (f *ageFSFile) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if err := f.checkPolicy(); err != nil {
+		return fs.ToErrno(err)
+	}
+	if f.shouldEncrypt {
+		// fallocate(2) on the ciphertext would corrupt it.
+		f.content.mu.Lock()
+		defer f.content.mu.Unlock()
+		return fs.ToErrno(f.content.allocate(off, sz, mode))
+	}
 	err := syscall.Fallocate(f.fd, mode, int64(off), int64(sz))
 	if err != nil {
 		return fs.ToErrno(err)
@@ -23,6 +34,29 @@ func (f *ageFSFile) Allocate(ctx context.Context, off uint64, sz uint64, mode ui
 	return fs.OK
 }
 
+// allocate emulates fallocate(2) on the plaintext. Encrypted files cannot
+// be sparse, so allocating extends the plaintext with zeros and punching a
+// hole fills the range with zeros.
+func (c *fileContent) allocate(off, sz uint64, mode uint32) error {
+	keepSize := mode&unix.FALLOC_FL_KEEP_SIZE != 0
+	switch mode &^ unix.FALLOC_FL_KEEP_SIZE {
+	case 0:
+		if keepSize {
+			return nil
+		}
+		return c.extend(off + sz)
+	case unix.FALLOC_FL_PUNCH_HOLE:
+		if !keepSize {
+			return syscall.EOPNOTSUPP
+		}
+		return c.zeroRange(off, sz, true)
+	case unix.FALLOC_FL_ZERO_RANGE:
+		return c.zeroRange(off, sz, keepSize)
+	default:
+		return syscall.EOPNOTSUPP
+	}
+}
+
 // Utimens - file handle based version of loopbackFileSystem.Utimens()
 func (f *ageFSFile) utimens(a *time.Time, m *time.Time) syscall.Errno {
 	var ts [2]syscall.Timespec
@@ -31,3 +65,44 @@ func (f *ageFSFile) utimens(a *time.Time, m *time.Time) syscall.Errno {
 	err := futimens(int(f.fd), &ts)
 	return fs.ToErrno(err)
 }
+
+// copyXattrs copies extended attributes of the file opened as srcFd to the
+// file opened as dstFd. Failures outside the user namespace are ignored since
+// they usually need privileges or are managed by the system.
+func copyXattrs(dstFd, srcFd int) error {
+	sz, err := unix.Flistxattr(srcFd, nil)
+	if err != nil || sz == 0 {
+		if err == syscall.ENOTSUP {
+			return nil
+		}
+		return err
+	}
+	names := make([]byte, sz)
+	sz, err = unix.Flistxattr(srcFd, names)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(names[:sz]), "\x00"), "\x00") {
+		if name == xattrNameDecryptedSize {
+			continue
+		}
+		err := copyXattr(dstFd, srcFd, name)
+		if err != nil && strings.HasPrefix(name, "user.") {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyXattr(dstFd, srcFd int, name string) error {
+	sz, err := unix.Fgetxattr(srcFd, name, nil)
+	if err != nil {
+		return err
+	}
+	value := make([]byte, sz)
+	sz, err = unix.Fgetxattr(srcFd, name, value)
+	if err != nil {
+		return err
+	}
+	return unix.Fsetxattr(dstFd, name, value[:sz], 0)
+}
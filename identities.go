@@ -8,7 +8,8 @@ import (
 // ParseIdentitiesFileOption is the option type for [ParseIdentitiesFile].
 type ParseIdentitiesFileOption = ageutil.ParseIdentitiesFileOption
 
-// WithPassphrase sets a function to get the passphrase for decrypting the identity file.
+// WithPassphrase sets a function to get the passphrase for decrypting the identity file
+// or the encrypted SSH key.
 func WithPassphrase(fn func() (string, error)) ParseIdentitiesFileOption {
 	return ageutil.WithPassphrase(fn)
 }
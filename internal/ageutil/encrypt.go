@@ -0,0 +1,127 @@
+package ageutil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+	"github.com/hnakamur/agefs/internal/ageutil/stream"
+)
+
+// FileKeySize is the size of the file key of an age file.
+const FileKeySize = 16
+
+// PayloadNonceSize is the size of the nonce preceding the payload of a
+// binary age file.
+const PayloadNonceSize = streamNonceSize
+
+// NewHeader returns the marshaled header of a binary age file with fileKey
+// wrapped to recipients.
+func NewHeader(fileKey []byte, recipients []age.Recipient) ([]byte, error) {
+	hdr, err := wrapFileKey(fileKey, recipients)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := hdr.Marshal(&buf); err != nil {
+		return nil, fmt.Errorf("failed to write header: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// EncryptedSize returns the size of the binary age file with the marshaled
+// header hdr encrypting size bytes of plaintext.
+func EncryptedSize(hdr []byte, size int64) int64 {
+	return int64(len(hdr)) + PayloadNonceSize + stream.EncryptedSize(size)
+}
+
+// EncryptingReaderAt reads arbitrary ranges of a binary age file encrypting
+// a plaintext of known size, encrypting only the chunks overlapping them.
+type EncryptingReaderAt struct {
+	// prefix is the header followed by the payload nonce.
+	prefix  []byte
+	payload *stream.EncryptingReaderAt
+}
+
+// NewEncryptingReaderAt returns a reader of the binary age file with the
+// marshaled header hdr, which must wrap fileKey, encrypting the plaintext of
+// size bytes read from src with the payload nonce. Unlike age.Encrypt, the
+// file is determined by the arguments, so a nonce must never be used with
+// the same file key for different plaintexts.
+func NewEncryptingReaderAt(hdr, fileKey, nonce []byte, src io.ReaderAt, size int64) (*EncryptingReaderAt, error) {
+	if len(nonce) != PayloadNonceSize {
+		return nil, fmt.Errorf("invalid nonce size: %d", len(nonce))
+	}
+	payload, err := stream.NewEncryptingReaderAt(streamKey(fileKey, nonce), src, size)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 0, len(hdr)+len(nonce))
+	prefix = append(append(prefix, hdr...), nonce...)
+	return &EncryptingReaderAt{prefix: prefix, payload: payload}, nil
+}
+
+// Size returns the size of the age file.
+func (r *EncryptingReaderAt) Size() int64 {
+	return int64(len(r.prefix)) + r.payload.Size()
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *EncryptingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	var n int
+	if off < int64(len(r.prefix)) {
+		n = copy(p, r.prefix[off:])
+		off += int64(n)
+	}
+	if n == len(p) {
+		return n, nil
+	}
+	nn, err := r.payload.ReadAt(p[n:], off-int64(len(r.prefix)))
+	return n + nn, err
+}
+
+// RecipientsFingerprint returns a string which identifies recipients by
+// their encodings. It returns false if some of them have no known encoding,
+// such as the recipients of SSH identities.
+func RecipientsFingerprint(recipients []age.Recipient) (string, bool) {
+	h := sha256.New()
+	for _, r := range recipients {
+		s, ok := r.(fmt.Stringer)
+		if !ok {
+			return "", false
+		}
+		fmt.Fprintln(h, s.String())
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// CheckRecipients returns an error unless one of identities can decrypt the
+// files encrypted to recipients. It wraps a random file key to recipients
+// and unwraps it, so plugins may be run and encrypted identities may ask for
+// their passphrases.
+func CheckRecipients(recipients []age.Recipient, identities []age.Identity) error {
+	fileKey := make([]byte, FileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return err
+	}
+	hdr, err := wrapFileKey(fileKey, recipients)
+	if err != nil {
+		return err
+	}
+	if _, err := UnwrapFileKey(hdr, identities); err != nil {
+		var errNoMatch *age.NoIdentityMatchError
+		if errors.As(err, &errNoMatch) {
+			return errors.New("none of the identities can decrypt files encrypted to the recipients")
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package ageutil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/hnakamur/agefs/internal/ageutil/stream"
+)
+
+func TestEncryptingReaderAt(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileKey := make([]byte, FileKeySize)
+	nonce := make([]byte, PayloadNonceSize)
+	for _, b := range [][]byte{fileKey, nonce} {
+		if _, err := rand.Read(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hdr, err := NewHeader(fileKey, []age.Recipient{id.Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const cs = stream.ChunkSize
+	for _, length := range []int{0, 1, cs, 2*cs + 1} {
+		t.Run(fmt.Sprintf("len=%d", length), func(t *testing.T) {
+			src := make([]byte, length)
+			if _, err := rand.Read(src); err != nil {
+				t.Fatal(err)
+			}
+			r, err := NewEncryptingReaderAt(hdr, fileKey, nonce, bytes.NewReader(src), int64(length))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Size() != EncryptedSize(hdr, int64(length)) {
+				t.Errorf("Size returned %d, expected %d", r.Size(), EncryptedSize(hdr, int64(length)))
+			}
+			encrypted, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(encrypted)) != r.Size() {
+				t.Errorf("read %d bytes, expected %d", len(encrypted), r.Size())
+			}
+
+			dr, err := age.Decrypt(bytes.NewReader(encrypted), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := io.ReadAll(dr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, src) {
+				t.Error("decrypted plaintext differs")
+			}
+
+			// A read straddling the header and the payload.
+			buf := make([]byte, 100)
+			off := int64(len(hdr)) - 10
+			n, err := r.ReadAt(buf, off)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], encrypted[off:off+int64(n)]) {
+				t.Errorf("wrong data at offset %d", off)
+			}
+		})
+	}
+}
+
+func TestRecipientsFingerprint(t *testing.T) {
+	const sshRecipient = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIArqk6X1etWOu0FXgPDAq7YoMQ6R50EHxGe4tSqkGEm2"
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1, err := ParseRecipient(id.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := ParseRecipient(sshRecipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r3, err := ParseRecipient(sshRecipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp1, ok := RecipientsFingerprint([]age.Recipient{r1, r2})
+	if !ok {
+		t.Fatal("no fingerprint for parsed recipients")
+	}
+	fp2, _ := RecipientsFingerprint([]age.Recipient{id.Recipient(), r3})
+	if fp1 != fp2 {
+		t.Error("fingerprints of the same recipients differ")
+	}
+	if fp3, _ := RecipientsFingerprint([]age.Recipient{r1}); fp3 == fp1 {
+		t.Error("fingerprints of different recipients are equal")
+	}
+}
+
+func TestCheckRecipients(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckRecipients([]age.Recipient{other.Recipient(), id.Recipient()}, []age.Identity{id}); err != nil {
+		t.Errorf("got error for recipients including the identity: %v", err)
+	}
+	if err := CheckRecipients([]age.Recipient{other.Recipient()}, []age.Identity{id}); err == nil {
+		t.Error("got no error for recipients without the identity")
+	}
+}
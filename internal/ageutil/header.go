@@ -0,0 +1,168 @@
+// Copyright 2019 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ageutil
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/hnakamur/agefs/internal/ageutil/format"
+	"github.com/hnakamur/agefs/internal/ageutil/stream"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const streamNonceSize = 16
+
+// IsArmored reports whether the file read from src starts with the armor
+// header.
+func IsArmored(src io.ReaderAt) (bool, error) {
+	start := make([]byte, len(armor.Header))
+	n, err := src.ReadAt(start, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return string(start[:n]) == armor.Header, nil
+}
+
+// IsEncrypted reports whether the file read from src starts with the
+// header of a binary or armored age file.
+func IsEncrypted(src io.ReaderAt) (bool, error) {
+	const intro = "age-encryption.org/"
+	start := make([]byte, len(intro))
+	n, err := src.ReadAt(start, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	if string(start[:n]) == intro {
+		return true, nil
+	}
+	return IsArmored(src)
+}
+
+// ParseHeader parses the header of a binary age file read from src. It
+// returns the header and its length in bytes, which is the offset of the
+// payload nonce.
+func ParseHeader(src io.Reader) (*format.Header, int64, error) {
+	cr := &countingReader{r: src}
+	br := bufio.NewReader(cr)
+	hdr, _, err := format.Parse(br)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read header: %w", err)
+	}
+	return hdr, cr.n - int64(br.Buffered()), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// UnwrapFileKey tries identities in order until one of them unwraps the file
+// key from hdr, and verifies the header MAC with it.
+func UnwrapFileKey(hdr *format.Header, identities []age.Identity) ([]byte, error) {
+	if len(identities) == 0 {
+		return nil, errors.New("no identities specified")
+	}
+
+	stanzas := make([]*age.Stanza, 0, len(hdr.Recipients))
+	for _, s := range hdr.Recipients {
+		stanzas = append(stanzas, (*age.Stanza)(s))
+	}
+	errNoMatch := &age.NoIdentityMatchError{}
+	var fileKey []byte
+	for _, id := range identities {
+		var err error
+		fileKey, err = id.Unwrap(stanzas)
+		if errors.Is(err, age.ErrIncorrectIdentity) {
+			errNoMatch.Errors = append(errNoMatch.Errors, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		break
+	}
+	if fileKey == nil {
+		return nil, errNoMatch
+	}
+
+	if mac, err := headerMAC(fileKey, hdr); err != nil {
+		return nil, fmt.Errorf("failed to compute header MAC: %v", err)
+	} else if !hmac.Equal(mac, hdr.MAC) {
+		return nil, errors.New("bad header MAC")
+	}
+	return fileKey, nil
+}
+
+// NewDecryptingReaderAt returns a reader which decrypts arbitrary ranges of
+// the binary age file of size bytes read from src. Armored files are not
+// supported since they cannot be read at random offsets.
+func NewDecryptingReaderAt(identities []age.Identity, src io.ReaderAt, size int64) (*stream.ReaderAt, error) {
+	hdr, hdrLen, err := ParseHeader(io.NewSectionReader(src, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := UnwrapFileKey(hdr, identities)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, streamNonceSize)
+	if _, err := src.ReadAt(nonce, hdrLen); err != nil {
+		return nil, fmt.Errorf("failed to read nonce: %w", err)
+	}
+	payloadOff := hdrLen + streamNonceSize
+	payload := io.NewSectionReader(src, payloadOff, size-payloadOff)
+	return stream.NewReaderAt(streamKey(fileKey, nonce), payload, size-payloadOff)
+}
+
+// PlaintextSize returns the plaintext size of the binary age file of size
+// bytes read from src. It parses only the header and decrypts nothing.
+func PlaintextSize(src io.ReaderAt, size int64) (int64, error) {
+	_, hdrLen, err := ParseHeader(io.NewSectionReader(src, 0, size))
+	if err != nil {
+		return 0, err
+	}
+	if size < hdrLen+streamNonceSize {
+		return 0, errors.New("failed to read nonce: file is truncated")
+	}
+	return stream.PlaintextSize(size - hdrLen - streamNonceSize)
+}
+
+func headerMAC(fileKey []byte, hdr *format.Header) ([]byte, error) {
+	h := hkdf.New(sha256.New, fileKey, nil, []byte("header"))
+	hmacKey := make([]byte, 32)
+	if _, err := io.ReadFull(h, hmacKey); err != nil {
+		return nil, err
+	}
+	hh := hmac.New(sha256.New, hmacKey)
+	if err := hdr.MarshalWithoutMAC(hh); err != nil {
+		return nil, err
+	}
+	return hh.Sum(nil), nil
+}
+
+func streamKey(fileKey, nonce []byte) []byte {
+	h := hkdf.New(sha256.New, fileKey, nonce, []byte("payload"))
+	streamKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, streamKey); err != nil {
+		panic("age: internal error: failed to read from HKDF: " + err.Error())
+	}
+	return streamKey
+}
@@ -0,0 +1,60 @@
+package ageutil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/hnakamur/agefs/internal/ageutil/stream"
+)
+
+func TestPlaintextSize(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const cs = stream.ChunkSize
+	for _, length := range []int{0, 1, 1000, cs, cs + 1, 2 * cs} {
+		t.Run(fmt.Sprintf("len=%d", length), func(t *testing.T) {
+			src := make([]byte, length)
+			if _, err := rand.Read(src); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			w, err := age.Encrypt(&buf, id.Recipient())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(src); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			encrypted := bytes.NewReader(buf.Bytes())
+
+			got, err := PlaintextSize(encrypted, encrypted.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != int64(length) {
+				t.Errorf("PlaintextSize returned %d, want %d", got, length)
+			}
+
+			r, err := NewDecryptingReaderAt([]age.Identity{id}, encrypted, encrypted.Size())
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, src) {
+				t.Error("decrypted content mismatch")
+			}
+		})
+	}
+}
@@ -2,9 +2,11 @@ package ageutil
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"filippo.io/age"
@@ -18,16 +20,37 @@ import (
 type ParseIdentitiesFileOption func(cfg *parseIdentitiesFileConfig)
 
 type parseIdentitiesFileConfig struct {
-	passphrase func() (string, error)
+	passphrase func(name string) (string, error)
 }
 
-// WithPassphrase sets a function to get the passphrase for decrypting the identity file.
+// WithPassphrase sets a function to get the passphrase for decrypting the identity file
+// or the encrypted SSH key.
 func WithPassphrase(fn func() (string, error)) ParseIdentitiesFileOption {
+	return WithPassphraseFor(func(string) (string, error) {
+		return fn()
+	})
+}
+
+// WithPassphraseFor is like [WithPassphrase], but fn is called with the name
+// of the file to decrypt, which may be one in a directory given to
+// [ParseIdentitiesPath].
+func WithPassphraseFor(fn func(name string) (string, error)) ParseIdentitiesFileOption {
 	return func(cfg *parseIdentitiesFileConfig) {
 		cfg.passphrase = fn
 	}
 }
 
+// passphraseFor returns the function to get the passphrase for the file
+// name, or nil if it is to be read from the terminal.
+func (cfg *parseIdentitiesFileConfig) passphraseFor(name string) func() (string, error) {
+	if cfg.passphrase == nil {
+		return nil
+	}
+	return func() (string, error) {
+		return cfg.passphrase(name)
+	}
+}
+
 // ParseIdentitiesFile parses a file that contains age or SSH keys. It returns
 // one or more of *age.X25519Identity, *agessh.RSAIdentity, *agessh.Ed25519Identity,
 // *agessh.EncryptedSSHIdentity, or *EncryptedIdentity.
@@ -62,7 +85,7 @@ func ParseIdentitiesFile(name string, opts ...ParseIdentitiesFileOption) ([]age.
 		if len(contents) == privateKeySizeLimit {
 			return nil, fmt.Errorf("failed to read %q: file too long", name)
 		}
-		passphrase := cfg.passphrase
+		passphrase := cfg.passphraseFor(name)
 		if passphrase == nil {
 			passphrase = func() (string, error) {
 				pass, err := readSecret(fmt.Sprintf("Enter passphrase for identity file %q:", name))
@@ -90,7 +113,7 @@ func ParseIdentitiesFile(name string, opts ...ParseIdentitiesFileOption) ([]age.
 		if len(contents) == privateKeySizeLimit {
 			return nil, fmt.Errorf("failed to read %q: file too long", name)
 		}
-		return parseSSHIdentity(name, contents)
+		return parseSSHIdentity(name, contents, cfg.passphraseFor(name))
 
 	// An unencrypted age identity file.
 	default:
@@ -142,7 +165,9 @@ func parseIdentities(f io.Reader) ([]age.Identity, error) {
 	return ids, nil
 }
 
-func parseSSHIdentity(name string, pemBytes []byte) ([]age.Identity, error) {
+// parseSSHIdentity parses an SSH private key. If it is encrypted, its
+// passphrase is read with passphrase, or from the terminal if nil.
+func parseSSHIdentity(name string, pemBytes []byte, passphrase func() (string, error)) ([]age.Identity, error) {
 	id, err := agessh.ParseIdentity(pemBytes)
 	if sshErr, ok := err.(*ssh.PassphraseMissingError); ok {
 		pubKey := sshErr.PublicKey
@@ -153,6 +178,10 @@ func parseSSHIdentity(name string, pemBytes []byte) ([]age.Identity, error) {
 			}
 		}
 		passphrasePrompt := func() ([]byte, error) {
+			if passphrase != nil {
+				pass, err := passphrase()
+				return []byte(pass), err
+			}
 			pass, err := readSecret(fmt.Sprintf("Enter passphrase for %q:", name))
 			if err != nil {
 				return nil, fmt.Errorf("could not read passphrase for %q: %v", name, err)
@@ -222,3 +251,58 @@ func IdentitiesToRecipients(ids []age.Identity) ([]age.Recipient, error) {
 	}
 	return recipients, nil
 }
+
+// sshAgentIdentityPrefix is the prefix of the identities which would be kept
+// in ssh-agent, such as "ssh-agent:".
+const sshAgentIdentityPrefix = "ssh-agent:"
+
+// errSSHAgentIdentity is returned for identities in ssh-agent. The agent
+// protocol only lets keys sign, while unwrapping ssh-ed25519 and ssh-rsa
+// stanzas needs X25519 key agreement and RSA-OAEP decryption with the
+// private keys.
+var errSSHAgentIdentity = errors.New("identities in ssh-agent are not supported, since ssh-agent cannot decrypt with SSH keys; use the private key file instead")
+
+// ParseIdentitiesPath is like [ParseIdentitiesFile], but if name is a
+// directory, it parses all the files in it in lexical order, skipping hidden
+// files and the ".pub" files of SSH keys. The other files which cannot be
+// parsed, such as the known_hosts and config files in ~/.ssh, are skipped
+// with a warning, and it fails only if no identity is found.
+func ParseIdentitiesPath(name string, opts ...ParseIdentitiesFileOption) ([]age.Identity, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		if strings.HasPrefix(name, sshAgentIdentityPrefix) {
+			return nil, errSSHAgentIdentity
+		}
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	if !fi.IsDir() {
+		return ParseIdentitiesFile(name, opts...)
+	}
+
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %v", err)
+	}
+	var ids []age.Identity
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") || strings.HasSuffix(e.Name(), ".pub") {
+			continue
+		}
+		path := filepath.Join(name, e.Name())
+		if fi, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("failed to open file: %v", err)
+		} else if fi.IsDir() {
+			continue
+		}
+		fileIDs, err := ParseIdentitiesFile(path, opts...)
+		if err != nil {
+			warningf("skipping a file which is not an identity: %v", err)
+			continue
+		}
+		ids = append(ids, fileIDs...)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no identities found in %q", name)
+	}
+	return ids, nil
+}
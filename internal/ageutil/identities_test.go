@@ -0,0 +1,168 @@
+package ageutil
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseIdentitiesPath(t *testing.T) {
+	dir := t.TempDir()
+	var want []string
+	for _, name := range []string{"b.txt", "a.txt"} {
+		id, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(id.String()+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+".pub"), []byte(id.Recipient().String()+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		want = append([]string{id.String()}, want...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".hidden"), []byte("not an identity\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "old"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Files found in ~/.ssh besides the keys are skipped.
+	for name, content := range map[string]string{
+		"authorized_keys": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHsKLqeplhpW+uObz5dvMgjz1OxfM/XXUB+VHtZ6isGN user@host\n",
+		"config":          "Host example\n\tUser git\n",
+		"known_hosts":     "example.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHsKLqeplhpW+uObz5dvMgjz1OxfM/XXUB+VHtZ6isGN\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids, err := ParseIdentitiesPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, id := range ids {
+		got = append(got, id.(*age.X25519Identity).String())
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("identities mismatch, got=%v, want=%v", got, want)
+	}
+
+	ids, err = ParseIdentitiesPath(filepath.Join(dir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0].(*age.X25519Identity).String() != want[0] {
+		t.Errorf("identities mismatch for a file, got=%v", ids)
+	}
+
+	if _, err := ParseIdentitiesPath(filepath.Join(dir, "old")); err == nil {
+		t.Error("got no error for a directory without identity files")
+	}
+	if _, err := ParseIdentitiesPath("ssh-agent:"); err != errSSHAgentIdentity {
+		t.Errorf("error mismatch for ssh-agent, got=%v, want=%v", err, errSSHAgentIdentity)
+	}
+}
+
+func TestParseIdentitiesFileWithPassphrase(t *testing.T) {
+	const passphrase = "correct horse"
+	dir := t.TempDir()
+
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(w, id.String())
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "age.key"), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "id_ed25519"), pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshRecipient, err := agessh.NewEd25519Recipient(sshPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]age.Recipient{"age.key": id.Recipient(), "id_ed25519": sshRecipient} {
+		ids, err := ParseIdentitiesFile(filepath.Join(dir, name), WithPassphrase(func() (string, error) {
+			return passphrase, nil
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileKey := make([]byte, FileKeySize)
+		if _, err := rand.Read(fileKey); err != nil {
+			t.Fatal(err)
+		}
+		hdr, err := wrapFileKey(fileKey, []age.Recipient{want})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := UnwrapFileKey(hdr, ids)
+		if err != nil {
+			t.Fatalf("unwrap with %s: %v", name, err)
+		}
+		if !bytes.Equal(got, fileKey) {
+			t.Errorf("file key mismatch for %s", name)
+		}
+	}
+
+	// The passphrase of a key in a directory is asked for with its path.
+	var asked []string
+	ids, err := ParseIdentitiesPath(dir, WithPassphraseFor(func(name string) (string, error) {
+		asked = append(asked, name)
+		return passphrase, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := wrapFileKey(make([]byte, FileKeySize), []age.Recipient{sshRecipient})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnwrapFileKey(hdr, ids); err != nil {
+		t.Fatal(err)
+	}
+	if len(asked) == 0 || asked[len(asked)-1] != filepath.Join(dir, "id_ed25519") {
+		t.Errorf("passphrase asked for mismatch, got=%q", asked)
+	}
+}
@@ -22,14 +22,28 @@ func (gitHubRecipientError) Error() string {
 	return `"github:" recipients were removed from the design`
 }
 
+// ParseRecipient parses a recipient in any of the formats accepted in a
+// recipients file.
+func ParseRecipient(arg string) (age.Recipient, error) {
+	return parseRecipient(arg)
+}
+
 func parseRecipient(arg string) (age.Recipient, error) {
 	switch {
 	case strings.HasPrefix(arg, "age1") && strings.Count(arg, "1") > 1:
-		return plugin.NewRecipient(arg, pluginTerminalUI)
+		r, err := plugin.NewRecipient(arg, pluginTerminalUI)
+		if err != nil {
+			return nil, err
+		}
+		return &encodedRecipient{Recipient: r, encoding: arg}, nil
 	case strings.HasPrefix(arg, "age1"):
 		return age.ParseX25519Recipient(arg)
 	case strings.HasPrefix(arg, "ssh-"):
-		return agessh.ParseRecipient(arg)
+		r, err := agessh.ParseRecipient(arg)
+		if err != nil {
+			return nil, err
+		}
+		return &encodedRecipient{Recipient: r, encoding: arg}, nil
 	case strings.HasPrefix(arg, "github:"):
 		name := strings.TrimPrefix(arg, "github:")
 		return nil, gitHubRecipientError{name}
@@ -38,6 +52,22 @@ func parseRecipient(arg string) (age.Recipient, error) {
 	return nil, fmt.Errorf("unknown recipient type: %q", arg)
 }
 
+// encodedRecipient is a recipient which remembers the encoding it was parsed
+// from, so that it can be told apart from others without wrapping a file key.
+// X25519 recipients are returned as is since they have a String method.
+type encodedRecipient struct {
+	age.Recipient
+	encoding string
+}
+
+func (r *encodedRecipient) WrapWithLabels(fileKey []byte) ([]*age.Stanza, []string, error) {
+	return wrapWithLabels(r.Recipient, fileKey)
+}
+
+func (r *encodedRecipient) String() string {
+	return r.encoding
+}
+
 func ParseRecipientsFile(name string) ([]age.Recipient, error) {
 	f, err := os.Open(name)
 	if err != nil {
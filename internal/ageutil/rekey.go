@@ -0,0 +1,132 @@
+// Copyright 2019 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ageutil
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/hnakamur/agefs/internal/ageutil/format"
+)
+
+// Rekey copies the age file read from src to dst, replacing the recipient
+// stanzas of the header with ones wrapping the same file key to recipients.
+// The payload is copied as is since it only depends on the file key.
+// Armored files are written armored.
+//
+// Anyone who has unwrapped the file key from an older copy of the file can
+// still decrypt the new one, so use [Reencrypt] to revoke their access.
+func Rekey(dst io.Writer, src io.Reader, identities []age.Identity, recipients []age.Recipient) error {
+	br := bufio.NewReader(src)
+	start, _ := br.Peek(len(armor.Header))
+	if string(start) != armor.Header {
+		return rekey(dst, br, identities, recipients)
+	}
+
+	aw := armor.NewWriter(dst)
+	if err := rekey(aw, armor.NewReader(br), identities, recipients); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// Reencrypt is like [Rekey], but decrypts the payload and encrypts it again
+// with a new file key, so that the old file key no longer decrypts it.
+func Reencrypt(dst io.Writer, src io.Reader, identities []age.Identity, recipients []age.Recipient) error {
+	br := bufio.NewReader(src)
+	start, _ := br.Peek(len(armor.Header))
+	r, err := NewDecryptingReader(identities, br)
+	if err != nil {
+		return err
+	}
+	w, err := NewEncryptingWriter(recipients, dst, string(start) == armor.Header)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func rekey(dst io.Writer, src io.Reader, identities []age.Identity, recipients []age.Recipient) error {
+	hdr, payload, err := format.Parse(src)
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+	fileKey, err := UnwrapFileKey(hdr, identities)
+	if err != nil {
+		return err
+	}
+
+	newHdr, err := wrapFileKey(fileKey, recipients)
+	if err != nil {
+		return err
+	}
+	if err := newHdr.Marshal(dst); err != nil {
+		return fmt.Errorf("failed to write header: %v", err)
+	}
+	if _, err := io.Copy(dst, payload); err != nil {
+		return err
+	}
+	return nil
+}
+
+// wrapFileKey returns a header with fileKey wrapped to recipients, in the
+// same way as age.Encrypt.
+func wrapFileKey(fileKey []byte, recipients []age.Recipient) (*format.Header, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients specified")
+	}
+
+	hdr := &format.Header{}
+	var labels []string
+	for i, r := range recipients {
+		stanzas, l, err := wrapWithLabels(r, fileKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap key for recipient #%d: %v", i, err)
+		}
+		sort.Strings(l)
+		if i == 0 {
+			labels = l
+		} else if !slicesEqual(labels, l) {
+			return nil, fmt.Errorf("incompatible recipients")
+		}
+		for _, s := range stanzas {
+			hdr.Recipients = append(hdr.Recipients, (*format.Stanza)(s))
+		}
+	}
+	if mac, err := headerMAC(fileKey, hdr); err != nil {
+		return nil, fmt.Errorf("failed to compute header MAC: %v", err)
+	} else {
+		hdr.MAC = mac
+	}
+	return hdr, nil
+}
+
+func wrapWithLabels(r age.Recipient, fileKey []byte) (s []*age.Stanza, labels []string, err error) {
+	if r, ok := r.(age.RecipientWithLabels); ok {
+		return r.WrapWithLabels(fileKey)
+	}
+	s, err = r.Wrap(fileKey)
+	return
+}
+
+func slicesEqual(s1, s2 []string) bool {
+	if len(s1) != len(s2) {
+		return false
+	}
+	for i := range s1 {
+		if s1[i] != s2[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+package ageutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+func TestRekey(t *testing.T) {
+	oldID, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newID, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("hello, world\n")
+
+	for _, armored := range []bool{false, true} {
+		var buf bytes.Buffer
+		var out io.WriteCloser = nopCloser{&buf}
+		if armored {
+			out = armor.NewWriter(&buf)
+		}
+		w, err := age.Encrypt(out, oldID.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := out.Close(); err != nil {
+			t.Fatal(err)
+		}
+		encrypted := buf.Bytes()
+
+		var rekeyed bytes.Buffer
+		if err := Rekey(&rekeyed, bytes.NewReader(encrypted), []age.Identity{oldID}, []age.Recipient{newID.Recipient()}); err != nil {
+			t.Fatal(err)
+		}
+
+		if !armored {
+			_, hdrLen, err := ParseHeader(bytes.NewReader(encrypted))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasSuffix(rekeyed.Bytes(), encrypted[hdrLen:]) {
+				t.Error("payload changed")
+			}
+		}
+
+		r, err := NewDecryptingReader([]age.Identity{newID}, bytes.NewReader(rekeyed.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("decrypted content mismatch, armored=%v, got=%q, want=%q", armored, got, plaintext)
+		}
+
+		_, err = NewDecryptingReader([]age.Identity{oldID}, bytes.NewReader(rekeyed.Bytes()))
+		var errNoMatch *age.NoIdentityMatchError
+		if !errors.As(err, &errNoMatch) {
+			t.Errorf("old identity still decrypts, armored=%v, err=%v", armored, err)
+		}
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	oldID, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newID, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("hello, world\n")
+
+	for _, armored := range []bool{false, true} {
+		var buf bytes.Buffer
+		w, err := NewEncryptingWriter([]age.Recipient{oldID.Recipient()}, &buf, armored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		encrypted := buf.Bytes()
+
+		var reencrypted bytes.Buffer
+		if err := Reencrypt(&reencrypted, bytes.NewReader(encrypted), []age.Identity{oldID}, []age.Recipient{newID.Recipient()}); err != nil {
+			t.Fatal(err)
+		}
+		if got := bytes.HasPrefix(reencrypted.Bytes(), []byte(armor.Header)); got != armored {
+			t.Errorf("armor mismatch, got=%v, want=%v", got, armored)
+		}
+
+		r, err := NewDecryptingReader([]age.Identity{newID}, bytes.NewReader(reencrypted.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("decrypted content mismatch, armored=%v, got=%q, want=%q", armored, got, plaintext)
+		}
+
+		if !armored {
+			oldHdr, _, err := ParseHeader(bytes.NewReader(encrypted))
+			if err != nil {
+				t.Fatal(err)
+			}
+			newHdr, _, err := ParseHeader(bytes.NewReader(reencrypted.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			oldKey, err := UnwrapFileKey(oldHdr, []age.Identity{oldID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			newKey, err := UnwrapFileKey(newHdr, []age.Identity{newID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(oldKey, newKey) {
+				t.Error("file key must change")
+			}
+		}
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,454 @@
+// Copyright 2019 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package stream implements a variant of the STREAM chunked encryption scheme.
+package stream
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const ChunkSize = 64 * 1024
+
+type Reader struct {
+	a   cipher.AEAD
+	src io.Reader
+
+	unread []byte // decrypted but unread data, backed by buf
+	buf    [encChunkSize]byte
+
+	err   error
+	nonce [chacha20poly1305.NonceSize]byte
+}
+
+const (
+	encChunkSize  = ChunkSize + chacha20poly1305.Overhead
+	lastChunkFlag = 0x01
+)
+
+func NewReader(key []byte, src io.Reader) (*Reader, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		a:   aead,
+		src: src,
+	}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(r.unread) > 0 {
+		n := copy(p, r.unread)
+		r.unread = r.unread[n:]
+		return n, nil
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	last, err := r.readChunk()
+	if err != nil {
+		r.err = err
+		return 0, err
+	}
+
+	n := copy(p, r.unread)
+	r.unread = r.unread[n:]
+
+	if last {
+		// Ensure there is an EOF after the last chunk as expected. In other
+		// words, check for trailing data after a full-length final chunk.
+		// Hopefully, the underlying reader supports returning EOF even if it
+		// had previously returned an EOF to ReadFull.
+		if _, err := r.src.Read(make([]byte, 1)); err == nil {
+			r.err = errors.New("trailing data after end of encrypted file")
+		} else if err != io.EOF {
+			r.err = fmt.Errorf("non-EOF error reading after end of encrypted file: %w", err)
+		} else {
+			r.err = io.EOF
+		}
+	}
+
+	return n, nil
+}
+
+// readChunk reads the next chunk of ciphertext from r.src and makes it available
+// in r.unread. last is true if the chunk was marked as the end of the message.
+// readChunk must not be called again after returning a last chunk or an error.
+func (r *Reader) readChunk() (last bool, err error) {
+	if len(r.unread) != 0 {
+		panic("stream: internal error: readChunk called with dirty buffer")
+	}
+
+	in := r.buf[:]
+	n, err := io.ReadFull(r.src, in)
+	switch {
+	case err == io.EOF:
+		// A message can't end without a marked chunk. This message is truncated.
+		return false, io.ErrUnexpectedEOF
+	case err == io.ErrUnexpectedEOF:
+		// The last chunk can be short, but not empty unless it's the first and
+		// only chunk.
+		if !nonceIsZero(&r.nonce) && n == r.a.Overhead() {
+			return false, errors.New("last chunk is empty, try age v1.0.0, and please consider reporting this")
+		}
+		in = in[:n]
+		last = true
+		setLastChunkFlag(&r.nonce)
+	case err != nil:
+		return false, err
+	}
+
+	outBuf := make([]byte, 0, ChunkSize)
+	out, err := r.a.Open(outBuf, r.nonce[:], in, nil)
+	if err != nil && !last {
+		// Check if this was a full-length final chunk.
+		last = true
+		setLastChunkFlag(&r.nonce)
+		out, err = r.a.Open(outBuf, r.nonce[:], in, nil)
+	}
+	if err != nil {
+		return false, errors.New("failed to decrypt and authenticate payload chunk")
+	}
+
+	incNonce(&r.nonce)
+	r.unread = r.buf[:copy(r.buf[:], out)]
+	return last, nil
+}
+
+func incNonce(nonce *[chacha20poly1305.NonceSize]byte) {
+	for i := len(nonce) - 2; i >= 0; i-- {
+		nonce[i]++
+		if nonce[i] != 0 {
+			break
+		} else if i == 0 {
+			// The counter is 88 bits, this is unreachable.
+			panic("stream: chunk counter wrapped around")
+		}
+	}
+}
+
+func setLastChunkFlag(nonce *[chacha20poly1305.NonceSize]byte) {
+	nonce[len(nonce)-1] = lastChunkFlag
+}
+
+func nonceIsZero(nonce *[chacha20poly1305.NonceSize]byte) bool {
+	return *nonce == [chacha20poly1305.NonceSize]byte{}
+}
+
+type Writer struct {
+	a         cipher.AEAD
+	dst       io.Writer
+	unwritten []byte // backed by buf
+	buf       [encChunkSize]byte
+	nonce     [chacha20poly1305.NonceSize]byte
+	err       error
+}
+
+func NewWriter(key []byte, dst io.Writer) (*Writer, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		a:   aead,
+		dst: dst,
+	}
+	w.unwritten = w.buf[:0]
+	return w, nil
+}
+
+func (w *Writer) Write(p []byte) (n int, err error) {
+	// TODO: consider refactoring with a bytes.Buffer.
+	if w.err != nil {
+		return 0, w.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	total := len(p)
+	for len(p) > 0 {
+		freeBuf := w.buf[len(w.unwritten):ChunkSize]
+		n := copy(freeBuf, p)
+		p = p[n:]
+		w.unwritten = w.unwritten[:len(w.unwritten)+n]
+
+		if len(w.unwritten) == ChunkSize && len(p) > 0 {
+			if err := w.flushChunk(notLastChunk); err != nil {
+				w.err = err
+				return 0, err
+			}
+		}
+	}
+	return total, nil
+}
+
+// Close flushes the last chunk. It does not close the underlying Writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	w.err = w.flushChunk(lastChunk)
+	if w.err != nil {
+		return w.err
+	}
+
+	w.err = errors.New("stream.Writer is already closed")
+	return nil
+}
+
+const (
+	lastChunk    = true
+	notLastChunk = false
+)
+
+func (w *Writer) flushChunk(last bool) error {
+	if !last && len(w.unwritten) != ChunkSize {
+		panic("stream: internal error: flush called with partial chunk")
+	}
+
+	if last {
+		setLastChunkFlag(&w.nonce)
+	}
+	buf := w.a.Seal(w.buf[:0], w.nonce[:], w.unwritten, nil)
+	_, err := w.dst.Write(buf)
+	w.unwritten = w.buf[:0]
+	incNonce(&w.nonce)
+	return err
+}
+
+// PlaintextSize returns the size of the plaintext encrypted into a STREAM
+// payload of encSize bytes, without decrypting it. A last chunk too short to
+// hold its tag means that the payload was truncated, which would otherwise
+// go unnoticed by reads not reaching the last chunk.
+func PlaintextSize(encSize int64) (int64, error) {
+	if encSize < chacha20poly1305.Overhead {
+		return 0, errors.New("payload is truncated")
+	}
+	chunks := (encSize + encChunkSize - 1) / encChunkSize
+	lastLen := encSize - (chunks-1)*encChunkSize
+	if lastLen < chacha20poly1305.Overhead {
+		return 0, errors.New("payload is truncated")
+	}
+	if chunks > 1 && lastLen == chacha20poly1305.Overhead {
+		return 0, errors.New("last chunk is empty")
+	}
+	return encSize - chunks*chacha20poly1305.Overhead, nil
+}
+
+// ReaderAt decrypts individual chunks of a STREAM payload of known size,
+// without reading the chunks before them.
+type ReaderAt struct {
+	a       cipher.AEAD
+	src     io.ReaderAt
+	encSize int64
+	size    int64
+	chunks  int64
+}
+
+func NewReaderAt(key []byte, src io.ReaderAt, encSize int64) (*ReaderAt, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	size, err := PlaintextSize(encSize)
+	if err != nil {
+		return nil, err
+	}
+	return &ReaderAt{
+		a:       aead,
+		src:     src,
+		encSize: encSize,
+		size:    size,
+		chunks:  (encSize + encChunkSize - 1) / encChunkSize,
+	}, nil
+}
+
+// Size returns the size of the plaintext.
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+// Chunks returns the number of chunks in the payload.
+func (r *ReaderAt) Chunks() int64 {
+	return r.chunks
+}
+
+// ReadChunk decrypts and authenticates the chunk at index i, which holds the
+// plaintext starting at offset i*ChunkSize.
+func (r *ReaderAt) ReadChunk(i int64) ([]byte, error) {
+	if i < 0 || i >= r.chunks {
+		return nil, fmt.Errorf("chunk index %d out of range", i)
+	}
+	off := i * encChunkSize
+	n := r.encSize - off
+	if n > encChunkSize {
+		n = encChunkSize
+	}
+	in := make([]byte, n)
+	if _, err := r.src.ReadAt(in, off); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	setNonceCounter(&nonce, uint64(i))
+	if i == r.chunks-1 {
+		setLastChunkFlag(&nonce)
+	}
+	out, err := r.a.Open(in[:0], nonce[:], in, nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt and authenticate payload chunk")
+	}
+	return out, nil
+}
+
+// ReadAt implements io.ReaderAt by decrypting every chunk that overlaps p.
+// It never reads past Size.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	var n int
+	for n < len(p) && off < r.size {
+		chunk, err := r.ReadChunk(off / ChunkSize)
+		if err != nil {
+			return n, err
+		}
+		nn := copy(p[n:], ClampChunk(chunk, off, r.size))
+		if nn == 0 {
+			// The chunk is shorter than the size implies.
+			return n, io.ErrUnexpectedEOF
+		}
+		n += nn
+		off += int64(nn)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// ClampChunk returns the plaintext of chunk from offset off of the whole
+// plaintext, which is at most size bytes long.
+func ClampChunk(chunk []byte, off, size int64) []byte {
+	start := off % ChunkSize
+	if end := start + size - off; end < int64(len(chunk)) {
+		chunk = chunk[:end]
+	}
+	if start > int64(len(chunk)) {
+		return nil
+	}
+	return chunk[start:]
+}
+
+func setNonceCounter(nonce *[chacha20poly1305.NonceSize]byte, counter uint64) {
+	for i := len(nonce) - 2; i >= 0 && counter != 0; i-- {
+		nonce[i] = byte(counter)
+		counter >>= 8
+	}
+}
+
+// EncryptedSize returns the size of the STREAM payload encrypting size bytes
+// of plaintext. It is the inverse of PlaintextSize.
+func EncryptedSize(size int64) int64 {
+	chunks := (size + ChunkSize - 1) / ChunkSize
+	if chunks == 0 {
+		// An empty plaintext is encrypted to a single empty chunk.
+		chunks = 1
+	}
+	return size + chunks*chacha20poly1305.Overhead
+}
+
+// EncryptingReaderAt encrypts individual chunks of a plaintext of known size
+// into a STREAM payload, without reading the chunks before them. The payload
+// is the same as the one written by Writer.
+type EncryptingReaderAt struct {
+	a       cipher.AEAD
+	src     io.ReaderAt
+	size    int64
+	encSize int64
+	chunks  int64
+}
+
+func NewEncryptingReaderAt(key []byte, src io.ReaderAt, size int64) (*EncryptingReaderAt, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	encSize := EncryptedSize(size)
+	return &EncryptingReaderAt{
+		a:       aead,
+		src:     src,
+		size:    size,
+		encSize: encSize,
+		chunks:  (encSize + encChunkSize - 1) / encChunkSize,
+	}, nil
+}
+
+// Size returns the size of the payload.
+func (r *EncryptingReaderAt) Size() int64 {
+	return r.encSize
+}
+
+// SealChunk reads and encrypts the chunk at index i, which holds the
+// plaintext starting at offset i*ChunkSize.
+func (r *EncryptingReaderAt) SealChunk(i int64) ([]byte, error) {
+	if i < 0 || i >= r.chunks {
+		return nil, fmt.Errorf("chunk index %d out of range", i)
+	}
+	off := i * ChunkSize
+	n := r.size - off
+	if n > ChunkSize {
+		n = ChunkSize
+	}
+	in := make([]byte, n, n+chacha20poly1305.Overhead)
+	if nn, err := r.src.ReadAt(in, off); err != nil && !(err == io.EOF && int64(nn) == n) {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	setNonceCounter(&nonce, uint64(i))
+	if i == r.chunks-1 {
+		setLastChunkFlag(&nonce)
+	}
+	return r.a.Seal(in[:0], nonce[:], in, nil), nil
+}
+
+// ReadAt implements io.ReaderAt by encrypting every chunk that overlaps p.
+func (r *EncryptingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	var n int
+	for n < len(p) && off < r.encSize {
+		chunk, err := r.SealChunk(off / encChunkSize)
+		if err != nil {
+			return n, err
+		}
+		nn := copy(p[n:], chunk[off%encChunkSize:])
+		n += nn
+		off += int64(nn)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2019 The age Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stream_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/hnakamur/agefs/internal/ageutil/stream"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const cs = stream.ChunkSize
+
+func TestRoundTrip(t *testing.T) {
+	for _, stepSize := range []int{512, 600, 1000, cs} {
+		for _, length := range []int{0, 1000, cs, cs + 100} {
+			t.Run(fmt.Sprintf("len=%d,step=%d", length, stepSize),
+				func(t *testing.T) { testRoundTrip(t, stepSize, length) })
+		}
+	}
+}
+
+func testRoundTrip(t *testing.T, stepSize, length int) {
+	src := make([]byte, length)
+	if _, err := rand.Read(src); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := stream.NewWriter(key, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	for n < length {
+		b := length - n
+		if b > stepSize {
+			b = stepSize
+		}
+		nn, err := w.Write(src[n : n+b])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nn != b {
+			t.Errorf("Write returned %d, expected %d", nn, b)
+		}
+		n += nn
+
+		nn, err = w.Write(src[n:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nn != 0 {
+			t.Errorf("Write returned %d, expected 0", nn)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Error("Close returned an error:", err)
+	}
+
+	t.Logf("buffer size: %d", buf.Len())
+
+	r, err := stream.NewReader(key, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n = 0
+	readBuf := make([]byte, stepSize)
+	for n < length {
+		nn, err := r.Read(readBuf)
+		if err != nil {
+			t.Fatalf("Read error at index %d: %v", n, err)
+		}
+
+		if !bytes.Equal(readBuf[:nn], src[n:n+nn]) {
+			t.Errorf("wrong data at indexes %d - %d", n, n+nn)
+		}
+
+		n += nn
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	for _, length := range []int{0, 1000, cs, cs + 100, 3 * cs} {
+		t.Run(fmt.Sprintf("len=%d", length),
+			func(t *testing.T) { testReaderAt(t, length) })
+	}
+}
+
+func testReaderAt(t *testing.T, length int) {
+	src := make([]byte, length)
+	if _, err := rand.Read(src); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := stream.NewWriter(key, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := stream.PlaintextSize(int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(length) {
+		t.Errorf("PlaintextSize returned %d, expected %d", size, length)
+	}
+
+	er, err := stream.NewEncryptingReaderAt(key, bytes.NewReader(src), int64(length))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if er.Size() != int64(buf.Len()) || stream.EncryptedSize(int64(length)) != int64(buf.Len()) {
+		t.Errorf("EncryptedSize returned %d, expected %d", er.Size(), buf.Len())
+	}
+	encrypted, err := io.ReadAll(io.NewSectionReader(er, 0, er.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encrypted, buf.Bytes()) {
+		t.Error("EncryptingReaderAt differs from Writer")
+	}
+
+	r, err := stream.NewReaderAt(key, bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int{0, 1, cs - 1, cs, cs + 50, 2*cs + 7, length - 10, length} {
+		if off < 0 || off > length {
+			continue
+		}
+		readBuf := make([]byte, 200)
+		n, err := r.ReadAt(readBuf, int64(off))
+		want := src[off:]
+		if len(want) > len(readBuf) {
+			want = want[:len(readBuf)]
+		} else if err != io.EOF {
+			t.Errorf("ReadAt at %d returned %v, expected EOF", off, err)
+		}
+		if !bytes.Equal(readBuf[:n], want) {
+			t.Errorf("wrong data at offset %d", off)
+		}
+	}
+
+	if length > 0 {
+		tampered := append([]byte(nil), buf.Bytes()...)
+		tampered[len(tampered)-1] ^= 1
+		r, err := stream.NewReaderAt(key, bytes.NewReader(tampered), int64(len(tampered)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.ReadAt(make([]byte, 1), int64(length-1)); err == nil {
+			t.Error("ReadAt succeeded on a tampered chunk")
+		}
+	}
+}
+
+func TestPlaintextSizeTruncated(t *testing.T) {
+	encChunkSize := stream.EncryptedSize(cs)
+	for _, tailLen := range []int64{1, 5, chacha20poly1305.Overhead - 1, chacha20poly1305.Overhead} {
+		if _, err := stream.PlaintextSize(encChunkSize + tailLen); err == nil {
+			t.Errorf("PlaintextSize succeeded with a last chunk of %d bytes", tailLen)
+		}
+	}
+	if size, err := stream.PlaintextSize(encChunkSize + chacha20poly1305.Overhead + 1); err != nil || size != cs+1 {
+		t.Errorf("PlaintextSize returned %d, %v, expected %d", size, err, cs+1)
+	}
+}
@@ -0,0 +1,200 @@
+package agefs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"syscall"
+
+	"github.com/hnakamur/agefs/internal/ageutil"
+	"golang.org/x/sys/unix"
+)
+
+// encryptedSymlinkPrefix is prepended to the base64 encoded age file of an
+// encrypted symlink target.
+const encryptedSymlinkPrefix = "agefs-encrypted:"
+
+// xattrPrefixAgefs is the prefix of the names of the xattrs agefs uses
+// itself, which are never encrypted.
+const xattrPrefixAgefs = "user.agefs_"
+
+// WithMetadataEncryption makes the root encrypt the targets of symlinks and
+// the values of user xattrs under encrypted paths to the same recipients as
+// file contents. Encrypted targets and values are decrypted on read wherever
+// the files are. Without it, xattr values are read as they are, even if
+// they are age files set by the users.
+func WithMetadataEncryption() RootOption {
+	return func(r *ageFSRoot) {
+		r.encryptMetadata = true
+	}
+}
+
+// shouldEncryptMetadata reports whether the symlink target and user xattr
+// values of the file at relPath should be encrypted.
+func (r *ageFSRoot) shouldEncryptMetadata(relPath string) bool {
+	return r.encryptMetadata && r.shouldEncrypt(relPath)
+}
+
+// WithInternalXattrsExposed makes the xattrs agefs uses itself visible and
+// modifiable on the mount, which is meant only for troubleshooting. They are
+// hidden and protected by default, since modifying them corrupts the sizes
+// reported for encrypted files.
+func WithInternalXattrsExposed() RootOption {
+	return func(r *ageFSRoot) {
+		r.exposeInternalXattrs = true
+	}
+}
+
+// isInternalXattr reports whether attr is used by agefs itself.
+func isInternalXattr(attr string) bool {
+	return strings.HasPrefix(attr, xattrPrefixAgefs)
+}
+
+// isUserXattr reports whether attr is a user xattr which is not used by
+// agefs itself.
+func isUserXattr(attr string) bool {
+	return strings.HasPrefix(attr, "user.") && !isInternalXattr(attr)
+}
+
+// hidesXattr reports whether attr is hidden on the mount.
+func (r *ageFSRoot) hidesXattr(attr string) bool {
+	return !r.exposeInternalXattrs && isInternalXattr(attr)
+}
+
+func (r *ageFSRoot) encryptSymlinkTarget(relPath, target string) (string, error) {
+	var buf bytes.Buffer
+	if err := encryptTo(&buf, []byte(target), r.recipientsFor(relPath)); err != nil {
+		return "", err
+	}
+	return encryptedSymlinkPrefix + base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeSymlinkTarget returns the age file in target, or false if target
+// is not encrypted.
+func decodeSymlinkTarget(target []byte) ([]byte, bool, error) {
+	if !bytes.HasPrefix(target, []byte(encryptedSymlinkPrefix)) {
+		return nil, false, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(string(target[len(encryptedSymlinkPrefix):]))
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// decryptSymlinkTarget returns target itself if it is not encrypted or
+// metadata encryption is disabled.
+func (r *ageFSRoot) decryptSymlinkTarget(target []byte) ([]byte, error) {
+	if !r.encryptMetadata {
+		return target, nil
+	}
+	data, ok, err := decodeSymlinkTarget(target)
+	if err != nil || !ok {
+		return target, err
+	}
+	return readAndDecryptFile(bytes.NewReader(data), r.identities)
+}
+
+// symlinkTargetSize returns the size of target as decryptSymlinkTarget
+// returns it, without decrypting it.
+func (r *ageFSRoot) symlinkTargetSize(target []byte) (uint64, error) {
+	if !r.encryptMetadata {
+		return uint64(len(target)), nil
+	}
+	data, ok, err := decodeSymlinkTarget(target)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return uint64(len(target)), nil
+	}
+	sz, err := ageutil.PlaintextSize(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	return uint64(sz), nil
+}
+
+func (r *ageFSRoot) encryptXattrValue(relPath string, value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encryptTo(&buf, value, r.recipientsFor(relPath)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decryptXattrValue returns value itself if it is not encrypted or metadata
+// encryption is disabled.
+func (r *ageFSRoot) decryptXattrValue(value []byte) ([]byte, error) {
+	if !r.encryptMetadata {
+		return value, nil
+	}
+	// Reading from a bytes.Reader never fails.
+	if encrypted, _ := ageutil.IsEncrypted(bytes.NewReader(value)); !encrypted {
+		return value, nil
+	}
+	return readAndDecryptFile(bytes.NewReader(value), r.identities)
+}
+
+func readlink(path string) ([]byte, error) {
+	for l := 256; ; l *= 2 {
+		buf := make([]byte, l)
+		sz, err := syscall.Readlink(path, buf)
+		if err != nil {
+			return nil, err
+		}
+		if sz < len(buf) {
+			return buf[:sz], nil
+		}
+	}
+}
+
+func lgetxattr(path, attr string) ([]byte, error) {
+	for {
+		sz, err := unix.Lgetxattr(path, attr, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		sz, err = unix.Lgetxattr(path, attr, buf)
+		if err == unix.ERANGE {
+			// The value has grown in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:sz], nil
+	}
+}
+
+func llistxattr(path string) ([]byte, error) {
+	for {
+		sz, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		sz, err = unix.Llistxattr(path, buf)
+		if err == unix.ERANGE {
+			// The list has grown in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:sz], nil
+	}
+}
+
+// copyXattrResult copies value to dest following the conventions of
+// getxattr(2) and listxattr(2), where an empty dest asks for the size.
+func copyXattrResult(dest, value []byte) (uint32, syscall.Errno) {
+	if len(dest) == 0 {
+		return uint32(len(value)), 0
+	}
+	if len(dest) < len(value) {
+		return 0, syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
@@ -0,0 +1,114 @@
+package agefs
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestMetadataEncryption(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shouldEncrypt, err := readIgnorePatterns(strings.NewReader("plain/\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &ageFSRoot{
+		identities:      []age.Identity{id},
+		recipients:      []age.Recipient{id.Recipient()},
+		encryptMetadata: true,
+	}
+	r.policy.Store(&shouldEncrypt)
+
+	if !r.shouldEncryptMetadata("secret/link") || r.shouldEncryptMetadata("plain/link") {
+		t.Error("metadata must be encrypted only under encrypted paths")
+	}
+	if !isUserXattr("user.comment") || isUserXattr(xattrNameDecryptedSize) || isUserXattr("security.selinux") {
+		t.Error("only user xattrs not used by agefs must be encrypted")
+	}
+
+	const target = "../some/target"
+	encrypted, err := r.encryptSymlinkTarget("secret/link", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encrypted, encryptedSymlinkPrefix) || strings.Contains(encrypted, target) {
+		t.Errorf("symlink target must be encrypted, got=%q", encrypted)
+	}
+	for _, diskTarget := range []string{encrypted, target} {
+		got, err := r.decryptSymlinkTarget([]byte(diskTarget))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != target {
+			t.Errorf("symlink target mismatch, got=%q, want=%q", got, target)
+		}
+		sz, err := r.symlinkTargetSize([]byte(diskTarget))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sz != uint64(len(target)) {
+			t.Errorf("symlink size mismatch, got=%d, want=%d", sz, len(target))
+		}
+	}
+
+	value := []byte("note")
+	encryptedValue, err := r.encryptXattrValue("secret/file", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, diskValue := range [][]byte{encryptedValue, value} {
+		got, err := r.decryptXattrValue(diskValue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("xattr value mismatch, got=%q, want=%q", got, value)
+		}
+	}
+
+	// An age file set as a value or a target by the user is left as it is
+	// without the option.
+	r.encryptMetadata = false
+	got, err := r.decryptXattrValue(encryptedValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, encryptedValue) {
+		t.Errorf("xattr value must not be decrypted without metadata encryption, got=%q", got)
+	}
+	gotTarget, err := r.decryptSymlinkTarget([]byte(encrypted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotTarget) != encrypted {
+		t.Errorf("symlink target must not be decrypted without metadata encryption, got=%q", gotTarget)
+	}
+	if sz, err := r.symlinkTargetSize([]byte(encrypted)); err != nil || sz != uint64(len(encrypted)) {
+		t.Errorf("symlink size mismatch without metadata encryption, got=%d, %v, want=%d", sz, err, len(encrypted))
+	}
+}
+
+func TestHidesXattr(t *testing.T) {
+	r := &ageFSRoot{}
+	if !r.hidesXattr(xattrNameDecryptedSize) || r.hidesXattr("user.comment") {
+		t.Error("only internal xattrs must be hidden")
+	}
+	WithInternalXattrsExposed()(r)
+	if r.hidesXattr(xattrNameDecryptedSize) {
+		t.Error("internal xattrs must not be hidden when exposed")
+	}
+
+	value := []byte("user.comment\x00")
+	if sz, errno := copyXattrResult(nil, value); errno != 0 || sz != uint32(len(value)) {
+		t.Errorf("size mismatch, got=%d, %v, want=%d", sz, errno, len(value))
+	}
+	if _, errno := copyXattrResult(make([]byte, 4), value); errno != syscall.ERANGE {
+		t.Errorf("error mismatch, got=%v, want=%v", errno, syscall.ERANGE)
+	}
+}
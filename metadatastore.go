@@ -0,0 +1,447 @@
+package agefs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"go.uber.org/multierr"
+	"golang.org/x/sys/unix"
+)
+
+// MetadataBackend selects where agefs stores its per-file metadata, such as
+// the plaintext sizes of encrypted files.
+type MetadataBackend int
+
+const (
+	// MetadataAuto uses the sidecar index if it exists in the source
+	// directory or the source directory does not support user xattrs, and
+	// xattrs otherwise.
+	MetadataAuto MetadataBackend = iota
+	// MetadataXattr stores metadata in user xattrs of the files.
+	MetadataXattr
+	// MetadataSidecar stores metadata in the .agefs-metadata index in the
+	// root of the source directory, which is hidden on the mount.
+	MetadataSidecar
+)
+
+func (b MetadataBackend) String() string {
+	switch b {
+	case MetadataAuto:
+		return "auto"
+	case MetadataXattr:
+		return "xattr"
+	case MetadataSidecar:
+		return "sidecar"
+	default:
+		return "MetadataBackend(" + strconv.Itoa(int(b)) + ")"
+	}
+}
+
+// ParseMetadataBackend parses the name of a MetadataBackend returned by
+// its String method.
+func ParseMetadataBackend(s string) (MetadataBackend, error) {
+	for _, b := range []MetadataBackend{MetadataAuto, MetadataXattr, MetadataSidecar} {
+		if s == b.String() {
+			return b, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown metadata backend: %s", s)
+}
+
+// WithMetadataBackend sets where agefs stores its per-file metadata. The
+// default is MetadataAuto.
+func WithMetadataBackend(b MetadataBackend) RootOption {
+	return func(r *ageFSRoot) {
+		r.metadataBackend = b
+	}
+}
+
+// sidecarFilename is the name of the sidecar index in the root of the
+// source directory. The names starting with it are reserved for agefs.
+const sidecarFilename = ".agefs-metadata"
+
+// isReservedPath reports whether the file at relPath is used by agefs
+// itself.
+func isReservedPath(relPath string) bool {
+	return (strings.HasPrefix(relPath, sidecarFilename) || strings.HasPrefix(relPath, reverseStateFilename)) &&
+		!strings.ContainsRune(relPath, os.PathSeparator)
+}
+
+// metadataStore stores named values for files like xattrs. get returns
+// ENODATA for a missing value, and set takes the flags of setxattr(2).
+type metadataStore interface {
+	get(path, name string) ([]byte, error)
+	set(path, name string, value []byte, flags int) error
+	remove(path, name string) error
+	// forget drops the values of the file with st, which has been removed.
+	forget(st *syscall.Stat_t) error
+	// batch calls fn, in which the values may be stored only when fn
+	// returns, for walks over the source directory.
+	batch(fn func() error) error
+}
+
+func openMetadataStore(rootPath string, b MetadataBackend) (metadataStore, error) {
+	switch b {
+	case MetadataXattr:
+		return xattrStore{}, nil
+	case MetadataSidecar:
+		return &sidecarStore{rootPath: rootPath}, nil
+	case MetadataAuto:
+	default:
+		return nil, fmt.Errorf("unknown metadata backend: %v", b)
+	}
+
+	if _, err := os.Lstat(filepath.Join(rootPath, sidecarFilename)); err == nil {
+		return &sidecarStore{rootPath: rootPath}, nil
+	}
+	if _, err := unix.Lgetxattr(rootPath, xattrNameSizeKey, nil); errors.Is(err, unix.ENOTSUP) {
+		return &sidecarStore{rootPath: rootPath}, nil
+	}
+	return xattrStore{}, nil
+}
+
+// metadata returns the metadata store of the root.
+func (r *ageFSRoot) metadata() metadataStore {
+	if r.metadataStore == nil {
+		return xattrStore{}
+	}
+	return r.metadataStore
+}
+
+type xattrStore struct{}
+
+func (xattrStore) get(path, name string) ([]byte, error) {
+	return lgetxattr(path, name)
+}
+
+func (xattrStore) set(path, name string, value []byte, flags int) error {
+	return unix.Lsetxattr(path, name, value, flags)
+}
+
+func (xattrStore) remove(path, name string) error {
+	return unix.Lremovexattr(path, name)
+}
+
+func (xattrStore) forget(st *syscall.Stat_t) error {
+	return nil
+}
+
+func (xattrStore) batch(fn func() error) error {
+	return fn()
+}
+
+// sidecarStore keeps the values in an index file keyed by device and inode
+// number, so that they follow the files when renamed. The index is locked
+// with flock(2) on the source directory while it is modified, so that it can
+// be shared with the other processes.
+type sidecarStore struct {
+	rootPath string
+
+	// mu protects the fields below.
+	mu       sync.Mutex
+	entries  map[sidecarKey][]byte
+	loadedSt syscall.Stat_t
+	// batchDir is the locked source directory while modifications are
+	// batched, and dirty reports whether the entries have been modified
+	// since.
+	batchDir *os.File
+	dirty    bool
+}
+
+type sidecarKey struct {
+	dev  uint64
+	ino  uint64
+	name string
+}
+
+func (s *sidecarStore) key(path, name string) (sidecarKey, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return sidecarKey{}, err
+	}
+	return sidecarKey{dev: uint64(st.Dev), ino: st.Ino, name: name}, nil
+}
+
+func (s *sidecarStore) get(path, name string) ([]byte, error) {
+	k, err := s.key(path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	value, ok := s.entries[k]
+	if !ok {
+		return nil, syscall.ENODATA
+	}
+	return value, nil
+}
+
+func (s *sidecarStore) set(path, name string, value []byte, flags int) error {
+	k, err := s.key(path, name)
+	if err != nil {
+		return err
+	}
+	return s.modify(func() error {
+		_, ok := s.entries[k]
+		if ok && flags&unix.XATTR_CREATE != 0 {
+			return syscall.EEXIST
+		}
+		if !ok && flags&unix.XATTR_REPLACE != 0 {
+			return syscall.ENODATA
+		}
+		s.entries[k] = append([]byte(nil), value...)
+		return nil
+	})
+}
+
+func (s *sidecarStore) remove(path, name string) error {
+	k, err := s.key(path, name)
+	if err != nil {
+		return err
+	}
+	return s.modify(func() error {
+		if _, ok := s.entries[k]; !ok {
+			return syscall.ENODATA
+		}
+		delete(s.entries, k)
+		return nil
+	})
+}
+
+func (s *sidecarStore) forget(st *syscall.Stat_t) error {
+	s.mu.Lock()
+	found := false
+	if err := s.load(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	for k := range s.entries {
+		if k.dev == uint64(st.Dev) && k.ino == st.Ino {
+			found = true
+			break
+		}
+	}
+	s.mu.Unlock()
+	if !found {
+		return nil
+	}
+
+	return s.modify(func() error {
+		for k := range s.entries {
+			if k.dev == uint64(st.Dev) && k.ino == st.Ino {
+				delete(s.entries, k)
+			}
+		}
+		return nil
+	})
+}
+
+// batch keeps the index locked while fn is called, and writes the entries
+// modified in it back only once when fn returns, even if fn fails, instead of
+// on each modification.
+func (s *sidecarStore) batch(fn func() error) (err error) {
+	s.mu.Lock()
+	if s.batchDir != nil {
+		s.mu.Unlock()
+		return fn()
+	}
+	dir, err := s.lock()
+	if err == nil {
+		if err = s.load(); err != nil {
+			dir.Close()
+		}
+	}
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.batchDir = dir
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.dirty {
+			if saveErr := s.save(); saveErr != nil {
+				s.entries = nil
+				err = multierr.Append(err, saveErr)
+			}
+		}
+		s.batchDir = nil
+		s.dirty = false
+		err = multierr.Append(err, dir.Close())
+	}()
+	return fn()
+}
+
+// lock opens the source directory and locks it. Closing the directory
+// unlocks it.
+func (s *sidecarStore) lock() (*os.File, error) {
+	dir, err := os.Open(s.rootPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(dir.Fd()), syscall.LOCK_EX); err != nil {
+		dir.Close()
+		return nil, err
+	}
+	return dir, nil
+}
+
+// modify applies fn to the entries read from the index while it is locked
+// and writes them back unless fn fails. While modifications are batched,
+// they are written back by batch instead.
+func (s *sidecarStore) modify(fn func() error) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.batchDir != nil {
+		if err := fn(); err != nil {
+			return err
+		}
+		s.dirty = true
+		return nil
+	}
+
+	dir, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = multierr.Append(err, dir.Close())
+	}()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		// Read the index again next time.
+		s.entries = nil
+		return err
+	}
+	return nil
+}
+
+// load reads the index unless it has not changed since it was last read.
+// s.mu must be held.
+func (s *sidecarStore) load() (err error) {
+	// No one else modifies the index while it is locked for batching.
+	if s.batchDir != nil {
+		return nil
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(s.rootPath, sidecarFilename), &st); err != nil {
+		if errors.Is(err, syscall.ENOENT) {
+			s.entries = make(map[sidecarKey][]byte)
+			s.loadedSt = syscall.Stat_t{}
+			return nil
+		}
+		return err
+	}
+	if s.entries != nil && st.Ino == s.loadedSt.Ino && st.Size == s.loadedSt.Size && st.Mtim == s.loadedSt.Mtim {
+		return nil
+	}
+
+	f, err := os.Open(filepath.Join(s.rootPath, sidecarFilename))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = multierr.Append(err, f.Close())
+	}()
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return err
+	}
+
+	// Each line has a device number, an inode number, a name and a base64
+	// encoded value separated by spaces. The lines written before device
+	// numbers were added lack them, and are for the device of the source
+	// directory.
+	var rootSt syscall.Stat_t
+	if err := syscall.Stat(s.rootPath, &rootSt); err != nil {
+		return err
+	}
+	entries := make(map[sidecarKey][]byte)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 {
+			fields = append([]string{strconv.FormatUint(uint64(rootSt.Dev), 10)}, fields...)
+		}
+		if len(fields) != 4 {
+			return fmt.Errorf("invalid line in %s: %q", sidecarFilename, scanner.Text())
+		}
+		dev, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid line in %s: %q", sidecarFilename, scanner.Text())
+		}
+		ino, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid line in %s: %q", sidecarFilename, scanner.Text())
+		}
+		value, err := base64.StdEncoding.DecodeString(fields[3])
+		if err != nil {
+			return fmt.Errorf("invalid line in %s: %q", sidecarFilename, scanner.Text())
+		}
+		entries[sidecarKey{dev: dev, ino: ino, name: fields[2]}] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	s.entries = entries
+	s.loadedSt = st
+	return nil
+}
+
+// save replaces the index with the entries. s.mu must be held.
+func (s *sidecarStore) save() (err error) {
+	var buf bytes.Buffer
+	for k, value := range s.entries {
+		fmt.Fprintf(&buf, "%d %d %s %s\n", k.dev, k.ino, k.name, base64.StdEncoding.EncodeToString(value))
+	}
+
+	tmp, err := os.CreateTemp(s.rootPath, sidecarFilename+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := syscall.Fstat(int(tmp.Fd()), &s.loadedSt); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.rootPath, sidecarFilename)); err != nil {
+		return err
+	}
+	return syncDir(s.rootPath)
+}
@@ -0,0 +1,118 @@
+package agefs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSidecarStore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.txt")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openMetadataStore(dir, MetadataSidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.get(path, xattrNameDecryptedSize); err != syscall.ENODATA {
+		t.Errorf("error mismatch for missing value, got=%v, want=%v", err, syscall.ENODATA)
+	}
+	if err := s.set(path, xattrNameDecryptedSize, []byte("5"), unix.XATTR_REPLACE); err != syscall.ENODATA {
+		t.Errorf("error mismatch for replacing missing value, got=%v, want=%v", err, syscall.ENODATA)
+	}
+	if err := s.set(path, xattrNameDecryptedSize, []byte("5"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.set(path, xattrNameDecryptedSize, []byte("6"), unix.XATTR_CREATE); err != syscall.EEXIST {
+		t.Errorf("error mismatch for creating existing value, got=%v, want=%v", err, syscall.EEXIST)
+	}
+
+	// The value follows the file when renamed, and is shared with another
+	// store found automatically.
+	newPath := filepath.Join(dir, "renamed.txt")
+	if err := os.Rename(path, newPath); err != nil {
+		t.Fatal(err)
+	}
+	s2, err := openMetadataStore(dir, MetadataAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s2.(*sidecarStore); !ok {
+		t.Fatalf("existing sidecar must be used, got=%T", s2)
+	}
+	if got, err := s2.get(newPath, xattrNameDecryptedSize); err != nil || !bytes.Equal(got, []byte("5")) {
+		t.Errorf("value mismatch, got=%q, err=%v", got, err)
+	}
+	if names, err := unix.Llistxattr(newPath, nil); err != nil || names != 0 {
+		t.Errorf("sidecar must not use xattrs, got size=%d, err=%v", names, err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(newPath, &st); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.forget(&st); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.get(newPath, xattrNameDecryptedSize); err != syscall.ENODATA {
+		t.Errorf("error mismatch for forgotten value, got=%v, want=%v", err, syscall.ENODATA)
+	}
+
+	// Batched values are readable at once but saved only at the end.
+	indexFilename := filepath.Join(dir, sidecarFilename)
+	before, err := os.ReadFile(indexFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.batch(func() error {
+		for _, v := range []string{"7", "8"} {
+			if err := s.set(newPath, xattrNameDecryptedSize, []byte(v), 0); err != nil {
+				return err
+			}
+		}
+		if got, err := s.get(newPath, xattrNameDecryptedSize); err != nil || string(got) != "8" {
+			t.Errorf("value mismatch in batch, got=%q, err=%v", got, err)
+		}
+		if got, err := os.ReadFile(indexFilename); err != nil || !bytes.Equal(got, before) {
+			t.Errorf("index must not be saved in batch, got=%q, err=%v", got, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s2.get(newPath, xattrNameDecryptedSize); err != nil || string(got) != "8" {
+		t.Errorf("value mismatch after batch, got=%q, err=%v", got, err)
+	}
+
+	// The entries are keyed by device too, and the ones without it are for
+	// the device of the source directory.
+	if err := syscall.Lstat(newPath, &st); err != nil {
+		t.Fatal(err)
+	}
+	index := fmt.Sprintf("%d %s %s\n%d %d %s %s\n",
+		st.Ino, xattrNameDecryptedSize, base64.StdEncoding.EncodeToString([]byte("9")),
+		uint64(st.Dev)+1, st.Ino, xattrNameSizeKey, base64.StdEncoding.EncodeToString([]byte("key")))
+	if err := os.WriteFile(indexFilename, []byte(index), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.get(newPath, xattrNameDecryptedSize); err != nil || string(got) != "9" {
+		t.Errorf("value mismatch for entry without device, got=%q, err=%v", got, err)
+	}
+	if _, err := s.get(newPath, xattrNameSizeKey); err != syscall.ENODATA {
+		t.Errorf("error mismatch for entry of another device, got=%v, want=%v", err, syscall.ENODATA)
+	}
+
+	if !isReservedPath(sidecarFilename) || !isReservedPath(sidecarFilename+".tmp-1") || isReservedPath("dir/"+sidecarFilename) {
+		t.Error("only the sidecar files in the root must be reserved")
+	}
+}
@@ -0,0 +1,260 @@
+package agefs
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/hnakamur/agefs/internal/ageutil"
+	"go.uber.org/multierr"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// nameKeyFilename is the file in the root of the source directory
+	// holding the key to encrypt file names with, encrypted with age.
+	nameKeyFilename = ".agefs-names"
+	nameKeySize     = 32
+
+	// Names longer than maxNameLen once encrypted are stored as
+	// longNamePrefix followed by their hash, and the encrypted name is
+	// kept in the file with longNameSuffix appended to that name.
+	maxNameLen     = 255
+	longNamePrefix = "agefs.longname."
+	longNameSuffix = ".name"
+
+	nameSIVSize = 16
+)
+
+// WithNameEncryption makes the root encrypt the names of files and
+// directories in the source directory, while .ageignore patterns keep
+// matching plaintext paths. The key is read from the .agefs-names file in
+// the source directory with the identities, and created encrypted to the
+// recipients if the file does not exist. The names of the .ageignore files
+// are not encrypted.
+//
+// Equal names are encrypted to equal names wherever they are, and offline
+// commands such as SourceDir do not support encrypted names.
+func WithNameEncryption() RootOption {
+	return func(r *ageFSRoot) {
+		r.encryptNames = true
+	}
+}
+
+// nameCipher encrypts file names deterministically so that they can be
+// looked up. It is a SIV construction with HMAC-SHA256 as the PRF and
+// ChaCha20 as the cipher, and the names are encoded in unpadded base64url.
+type nameCipher struct {
+	encKey []byte
+	macKey []byte
+}
+
+func newNameCipher(key []byte) *nameCipher {
+	derive := func(label string, size int) []byte {
+		k := make([]byte, size)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(label)), k); err != nil {
+			panic("agefs: internal error: failed to read from HKDF: " + err.Error())
+		}
+		return k
+	}
+	return &nameCipher{
+		encKey: derive("agefs name encryption", chacha20.KeySize),
+		macKey: derive("agefs name authentication", sha256.Size),
+	}
+}
+
+func (c *nameCipher) siv(name []byte) []byte {
+	h := hmac.New(sha256.New, c.macKey)
+	h.Write(name)
+	return h.Sum(nil)[:nameSIVSize]
+}
+
+func (c *nameCipher) xor(siv, dst, src []byte) {
+	s, err := chacha20.NewUnauthenticatedCipher(c.encKey, siv[:chacha20.NonceSize])
+	if err != nil {
+		panic("agefs: internal error: failed to create cipher: " + err.Error())
+	}
+	s.XORKeyStream(dst, src)
+}
+
+func (c *nameCipher) encrypt(name string) string {
+	siv := c.siv([]byte(name))
+	out := make([]byte, nameSIVSize+len(name))
+	copy(out, siv)
+	c.xor(siv, out[nameSIVSize:], []byte(name))
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+func (c *nameCipher) decrypt(encoded string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if len(data) <= nameSIVSize {
+		return "", errors.New("encrypted name is too short")
+	}
+	siv := data[:nameSIVSize]
+	name := make([]byte, len(data)-nameSIVSize)
+	c.xor(siv, name, data[nameSIVSize:])
+	if !hmac.Equal(siv, c.siv(name)) {
+		return "", errors.New("failed to authenticate encrypted name")
+	}
+	return string(name), nil
+}
+
+// loadNameCipher reads the key for encrypting names in the source directory
+// at rootPath, creating it if it does not exist.
+func loadNameCipher(rootPath string, identities []age.Identity, recipients []age.Recipient) (c *nameCipher, err error) {
+	path := filepath.Join(rootPath, nameKeyFilename)
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		return createNameCipher(path, recipients)
+	}
+	defer func() {
+		err = multierr.Append(err, f.Close())
+	}()
+
+	r, err := ageutil.NewDecryptingReader(identities, f)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt %s: %w", path, err)
+	}
+	key, err := io.ReadAll(io.LimitReader(r, nameKeySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt %s: %w", path, err)
+	}
+	if len(key) != nameKeySize {
+		return nil, fmt.Errorf("invalid key size in %s", path)
+	}
+	return newNameCipher(key), nil
+}
+
+func createNameCipher(path string, recipients []age.Recipient) (c *nameCipher, err error) {
+	key := make([]byte, nameKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = multierr.Append(err, f.Close())
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	if err := encryptTo(f, key, recipients); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	return newNameCipher(key), nil
+}
+
+// encodeName returns the name in the source directory of the file named
+// name on the mount.
+func (r *ageFSRoot) encodeName(name string) string {
+	if r.names == nil || isPolicyFile(name) {
+		return name
+	}
+	encoded := r.names.encrypt(name)
+	if len(encoded) <= maxNameLen {
+		return encoded
+	}
+	sum := sha256.Sum256([]byte(encoded))
+	return longNamePrefix + base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// decodeName returns the name on the mount of the file named diskName in
+// the directory dir of the source directory. ok is false for the files
+// which are not shown on the mount.
+func (r *ageFSRoot) decodeName(dir, diskName string) (name string, ok bool) {
+	if r.names == nil || isPolicyFile(diskName) {
+		return diskName, true
+	}
+	encoded := diskName
+	if strings.HasPrefix(diskName, longNamePrefix) {
+		if strings.HasSuffix(diskName, longNameSuffix) {
+			return "", false
+		}
+		data, err := os.ReadFile(filepath.Join(dir, diskName+longNameSuffix))
+		if err != nil {
+			return "", false
+		}
+		encoded = string(data)
+	}
+	name, err := r.names.decrypt(encoded)
+	if err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+// decodeRelPath returns the relative path on the mount of the file at rel
+// relative to the directory dir of the source directory.
+func (r *ageFSRoot) decodeRelPath(dir, rel string) (string, bool) {
+	if r.names == nil {
+		return rel, true
+	}
+	components := strings.Split(rel, string(os.PathSeparator))
+	for i, c := range components {
+		name, ok := r.decodeName(dir, c)
+		if !ok {
+			return "", false
+		}
+		dir = filepath.Join(dir, c)
+		components[i] = name
+	}
+	return filepath.Join(components...), true
+}
+
+// backingPath returns the path in the source directory of the file at
+// relPath on the mount.
+func (r *ageFSRoot) backingPath(relPath string) string {
+	if r.names == nil || relPath == "" {
+		return filepath.Join(r.Path, relPath)
+	}
+	components := strings.Split(relPath, string(os.PathSeparator))
+	for i, c := range components {
+		components[i] = r.encodeName(c)
+	}
+	return filepath.Join(r.Path, filepath.Join(components...))
+}
+
+// addLongName records the encrypted name of the file named name in the
+// directory dir of the source directory if it is too long. A record left by
+// a failed operation is harmless.
+func (r *ageFSRoot) addLongName(dir, name string) error {
+	diskName := r.encodeName(name)
+	if !strings.HasPrefix(diskName, longNamePrefix) {
+		return nil
+	}
+	return os.WriteFile(filepath.Join(dir, diskName+longNameSuffix), []byte(r.names.encrypt(name)), 0644)
+}
+
+// removeLongName removes the record added by addLongName.
+func (r *ageFSRoot) removeLongName(dir, name string) error {
+	diskName := r.encodeName(name)
+	if !strings.HasPrefix(diskName, longNamePrefix) {
+		return nil
+	}
+	if err := os.Remove(filepath.Join(dir, diskName+longNameSuffix)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package agefs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestNameCipher(t *testing.T) {
+	c := newNameCipher(make([]byte, nameKeySize))
+	for _, name := range []string{"a", "secret.txt", strings.Repeat("x", 255)} {
+		encoded := c.encrypt(name)
+		if encoded != c.encrypt(name) {
+			t.Errorf("encryption must be deterministic for %q", name)
+		}
+		if strings.ContainsAny(encoded, "/\x00") {
+			t.Errorf("encrypted name must be a valid file name, got=%q", encoded)
+		}
+		got, err := c.decrypt(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != name {
+			t.Errorf("name mismatch, got=%q, want=%q", got, name)
+		}
+
+		tampered := []byte(encoded)
+		if tampered[0] == 'A' {
+			tampered[0] = 'B'
+		} else {
+			tampered[0] = 'A'
+		}
+		if _, err := c.decrypt(string(tampered)); err == nil {
+			t.Errorf("tampered name must not be decrypted for %q", name)
+		}
+	}
+	if _, err := c.decrypt("plain.txt"); err == nil {
+		t.Error("plaintext name must not be decrypted")
+	}
+}
+
+func TestNameEncryption(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".ageignore"), []byte("*.pub\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	node, err := NewRoot(dir, []age.Identity{id}, nil, WithNameEncryption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := node.(*ageFSNode).root()
+
+	if got := r.encodeName(IgnoreFilename); got != IgnoreFilename {
+		t.Errorf("ignore file name must not be encrypted, got=%q", got)
+	}
+	longName := strings.Repeat("x", 250)
+	diskName := r.encodeName(longName)
+	if !strings.HasPrefix(diskName, longNamePrefix) || len(diskName)+len(longNameSuffix) > maxNameLen {
+		t.Errorf("long name must be shortened, got=%q", diskName)
+	}
+	if err := r.addLongName(dir, longName); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"secret.txt", longName, IgnoreFilename} {
+		got, ok := r.decodeName(dir, r.encodeName(name))
+		if !ok || got != name {
+			t.Errorf("name mismatch, got=%q, %v, want=%q", got, ok, name)
+		}
+	}
+	for _, diskName := range []string{nameKeyFilename, diskName + longNameSuffix, "plain.txt"} {
+		if _, ok := r.decodeName(dir, diskName); ok {
+			t.Errorf("%q must be hidden", diskName)
+		}
+	}
+	if err := r.removeLongName(dir, longName); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.decodeName(dir, diskName); ok {
+		t.Error("long name must not be decoded after removal")
+	}
+
+	// The key is created once and read by later mounts.
+	node2, err := NewRoot(dir, []age.Identity{id}, nil, WithNameEncryption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := node2.(*ageFSNode).root().encodeName("secret.txt"), r.encodeName("secret.txt"); got != want {
+		t.Errorf("encrypted name mismatch after remount, got=%q, want=%q", got, want)
+	}
+
+	if _, err := NewSourceDir(dir, []age.Identity{id}, nil); err == nil {
+		t.Error("source directory with encrypted names must be rejected")
+	}
+}
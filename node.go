@@ -1,20 +1,26 @@
 package agefs
 
 import (
+	"bytes"
 	"context"
-	"errors"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sync"
 	"syscall"
 	"unsafe"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hnakamur/agefs/internal/ageutil"
+	"go.uber.org/multierr"
+	"golang.org/x/sys/unix"
 )
 
 type ageFSNode struct {
 	fs.LoopbackNode
+
+	mu      sync.Mutex
+	content *fileContent
 }
 
 var _ = (fs.NodeStatfser)((*ageFSNode)(nil))
@@ -42,23 +48,86 @@ func (n *ageFSNode) root() *ageFSRoot {
 }
 
 func (n *ageFSNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	flags = flags &^ syscall.O_APPEND
+	relPath := n.relPath()
+	if n.root().reverse != nil {
+		return n.openReverse(flags, relPath)
+	}
+	openFlags := flags
+	if n.root().shouldEncrypt(relPath) {
+		if n.root().writeOnly() {
+			if flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+				return nil, 0, syscall.EACCES
+			}
+			fuseFlags = writeOnlyFuseFlags
+		}
+		// Truncate the plaintext instead, so that the ciphertext is
+		// replaced atomically on flush.
+		openFlags &^= syscall.O_TRUNC
+	}
 	p := n.path()
-	f, err := syscall.Open(p, int(flags), 0)
+	f, err := syscall.Open(p, int(openFlags), 0)
 	if err != nil {
 		return nil, 0, fs.ToErrno(err)
 	}
 
-	relPath := n.relPath()
-	lf := newFile(f, relPath, n)
-	return lf, 0, 0
+	lf, err := newFile(f, openFlags, relPath, n)
+	if err != nil {
+		syscall.Close(f)
+		return nil, 0, fs.ToErrno(err)
+	}
+	if lf.content != nil && flags&syscall.O_TRUNC != 0 {
+		lf.content.mu.Lock()
+		err = lf.content.truncate(0)
+		lf.content.mu.Unlock()
+		if err != nil {
+			lf.Release(ctx)
+			return nil, 0, fs.ToErrno(err)
+		}
+	}
+	return lf, fuseFlags, 0
+}
+
+// writeOnlyFuseFlags are the flags to open encrypted files with on a
+// write-only file system, which bypass the page cache so that the plaintext
+// written cannot be read back from it.
+const writeOnlyFuseFlags = fuse.FOPEN_DIRECT_IO
+
+// openReverse opens the file at relPath in reverse mode, where files can
+// only be read.
+func (n *ageFSNode) openReverse(flags uint32, relPath string) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	f, err := syscall.Open(n.path(), int(flags), 0)
+	if err != nil {
+		return nil, 0, fs.ToErrno(err)
+	}
+	if !n.root().shouldEncrypt(relPath) {
+		lf, err := newFile(f, flags, relPath, n)
+		if err != nil {
+			syscall.Close(f)
+			return nil, 0, fs.ToErrno(err)
+		}
+		return lf, 0, 0
+	}
+	rf, err := newReverseFile(f, relPath, n)
+	if err != nil {
+		syscall.Close(f)
+		return nil, 0, fs.ToErrno(err)
+	}
+	return rf, 0, 0
 }
 
 var _ = (fs.NodeCreater)((*ageFSNode)(nil))
 
 func (n *ageFSNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	p := filepath.Join(n.path(), name)
-	flags = flags &^ syscall.O_APPEND
+	if n.isReserved(name) {
+		return nil, nil, 0, syscall.EPERM
+	}
+	if err := n.root().addLongName(n.path(), name); err != nil {
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+	p := n.childPath(name)
 	fd, err := syscall.Open(p, int(flags)|os.O_CREATE, mode)
 	if err != nil {
 		return nil, nil, 0, fs.ToErrno(err)
@@ -71,27 +140,167 @@ func (n *ageFSNode) Create(ctx context.Context, name string, flags uint32, mode
 	}
 
 	node := n.root().newNode(n.EmbeddedInode(), name, &st)
-	ch := n.NewInode(ctx, node, n.root().idFromStat(&st))
+	ch := n.root().newInode(ctx, n.EmbeddedInode(), node, &st)
 	relPath := filepath.Join(n.relPath(), name)
-	lf := newFile(fd, relPath, n)
+	lf, err := newFile(fd, flags, relPath, ch.Operations().(*ageFSNode))
+	if err != nil {
+		syscall.Close(fd)
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+	if lf.shouldEncrypt && n.root().writeOnly() {
+		fuseFlags = writeOnlyFuseFlags
+	}
+
+	out.FromStat(&st)
+	return ch, lf, fuseFlags, 0
+}
+
+func (n *ageFSNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if fga, ok := f.(fs.FileGetattrer); ok {
+		return fga.Getattr(ctx, out)
+	}
 
+	p := n.path()
+	st := syscall.Stat_t{}
+	var err error
+	if n.IsRoot() {
+		err = syscall.Stat(p, &st)
+	} else {
+		err = syscall.Lstat(p, &st)
+	}
+	if err != nil {
+		return fs.ToErrno(err)
+	}
 	out.FromStat(&st)
-	return ch, lf, 0, 0
+	// The backing file may have been replaced on save.
+	out.Ino = n.StableAttr().Ino
+
+	if out.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		return fs.ToErrno(n.root().fixSymlinkSize(p, &out.Size))
+	}
+
+	// override file size with unencrpyted size
+	if out.Mode&syscall.S_IFMT == syscall.S_IFREG && n.root().shouldEncrypt(n.relPath()) {
+		sz, ok, err := n.openContentSize()
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+		if ok {
+			out.Size = uint64(sz)
+		} else if err := n.fixAttrSize(n.relPath(), p, &out.Size); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	return fs.OK
+}
+
+var _ = (fs.NodeSetattrer)((*ageFSNode)(nil))
+
+func (n *ageFSNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if f == nil {
+		if _, ok := in.GetSize(); ok && n.root().shouldEncrypt(n.relPath()) {
+			// Truncating the ciphertext by path would corrupt it, so
+			// truncate the plaintext through a temporary handle.
+			fh, _, errno := n.Open(ctx, syscall.O_WRONLY)
+			if errno != 0 {
+				return errno
+			}
+			errno = fh.(*ageFSFile).Setattr(ctx, in, out)
+			if rerrno := fh.(*ageFSFile).Release(ctx); errno == 0 {
+				errno = rerrno
+			}
+			return errno
+		}
+	}
+
+	if fsa, ok := f.(fs.FileSetattrer); ok {
+		return fsa.Setattr(ctx, in, out)
+	}
+	if err := n.setAttrByPath(in); err != nil {
+		return fs.ToErrno(err)
+	}
+	return n.Getattr(ctx, f, out)
+}
+
+func (n *ageFSNode) setAttrByPath(in *fuse.SetAttrIn) error {
+	p := n.path()
+	if m, ok := in.GetMode(); ok {
+		if err := syscall.Chmod(p, m); err != nil {
+			return err
+		}
+	}
+
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if uok || gok {
+		suid := -1
+		sgid := -1
+		if uok {
+			suid = int(uid)
+		}
+		if gok {
+			sgid = int(gid)
+		}
+		if err := syscall.Lchown(p, suid, sgid); err != nil {
+			return err
+		}
+	}
+
+	mtime, mok := in.GetMTime()
+	atime, aok := in.GetATime()
+	if mok || aok {
+		ap := &atime
+		mp := &mtime
+		if !aok {
+			ap = nil
+		}
+		if !mok {
+			mp = nil
+		}
+		ts := []unix.Timespec{
+			unix.Timespec(fuse.UtimeToTimespec(ap)),
+			unix.Timespec(fuse.UtimeToTimespec(mp)),
+		}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return err
+		}
+	}
+
+	if sz, ok := in.GetSize(); ok {
+		if err := syscall.Truncate(p, int64(sz)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // path returns the full path to the file in the underlying file
 // system.
 func (n *ageFSNode) path() string {
-	path := n.Path(n.Root())
-	return filepath.Join(n.RootData.Path, path)
+	return n.root().backingPath(n.relPath())
+}
+
+// childPath returns the full path to the child named name in the
+// underlying file system.
+func (n *ageFSNode) childPath(name string) string {
+	return filepath.Join(n.path(), n.root().encodeName(name))
 }
 
 func (n *ageFSNode) relPath() string {
 	return n.Path(n.Root())
 }
 
+// isReserved reports whether the child named name is used by agefs itself,
+// which is hidden on the mount.
+func (n *ageFSNode) isReserved(name string) bool {
+	return n.IsRoot() && isReservedPath(name)
+}
+
 func (n *ageFSNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	p := filepath.Join(n.path(), name)
+	if n.isReserved(name) {
+		return nil, syscall.ENOENT
+	}
+	p := n.childPath(name)
 
 	st := syscall.Stat_t{}
 	err := syscall.Lstat(p, &st)
@@ -102,20 +311,374 @@ func (n *ageFSNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut)
 	out.Attr.FromStat(&st)
 
 	// override file size with unencrpyted size
-	if st.Mode&syscall.S_IFREG != 0 {
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
 		relPath := filepath.Join(n.relPath(), name)
 		if n.root().shouldEncrypt(relPath) {
-			if err := n.fixAttrSize(p, &out.Attr.Size); err != nil {
+			if err := n.fixAttrSize(relPath, p, &out.Attr.Size); err != nil {
 				return nil, fs.ToErrno(err)
 			}
 		}
+	case syscall.S_IFLNK:
+		if err := n.root().fixSymlinkSize(p, &out.Attr.Size); err != nil {
+			return nil, fs.ToErrno(err)
+		}
 	}
 
 	node := n.root().newNode(n.EmbeddedInode(), name, &st)
-	ch := n.NewInode(ctx, node, n.root().idFromStat(&st))
+	ch := n.root().newInode(ctx, n.EmbeddedInode(), node, &st)
 	return ch, 0
 }
 
+// Rename converts the content of a regular file moved to a path with the
+// other encryption policy, so that no plaintext is left at an encrypted path
+// and vice versa. Renames that cannot be converted fail with EXDEV, which
+// makes programs such as mv(1) fall back to copying through the mount.
+func (n *ageFSNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) (errno syscall.Errno) {
+	if n.isReserved(name) || newParent.EmbeddedInode().IsRoot() && isReservedPath(newName) {
+		return syscall.EPERM
+	}
+	oldRelPath := filepath.Join(n.relPath(), name)
+	newRelPath := filepath.Join(newParent.EmbeddedInode().Path(nil), newName)
+	oldPath := n.root().backingPath(oldRelPath)
+	newPath := n.root().backingPath(newRelPath)
+	if err := n.root().addLongName(filepath.Dir(newPath), newName); err != nil {
+		return fs.ToErrno(err)
+	}
+	// The file replaced at the destination, whose inode number may be
+	// reused once it is gone.
+	targetSt := syscall.Stat_t{}
+	replaced := flags&fs.RENAME_EXCHANGE == 0 && syscall.Lstat(newPath, &targetSt) == nil &&
+		(targetSt.Nlink <= 1 || targetSt.Mode&syscall.S_IFMT == syscall.S_IFDIR)
+	st := syscall.Stat_t{}
+	defer func() {
+		if errno != 0 {
+			return
+		}
+		if replaced {
+			n.root().removedIno(newParent.EmbeddedInode().GetChild(newName), &targetSt)
+		}
+		if flags&fs.RENAME_EXCHANGE == 0 && oldPath != newPath {
+			errno = fs.ToErrno(n.root().removeLongName(filepath.Dir(oldPath), name))
+		}
+		// A directory may carry .ageignore files, which are not noticed
+		// unless the source directory is watched.
+		movedIgnoreFiles := isIgnoreFile(oldRelPath) || isIgnoreFile(newRelPath) ||
+			st.Mode&syscall.S_IFMT == syscall.S_IFDIR && !n.root().ignoreWatched.Load()
+		if n.root().reloadIgnore && movedIgnoreFiles {
+			// Errors are logged in reloadIgnoreFiles, and the rename itself
+			// has succeeded.
+			_ = n.root().reloadIgnoreFiles()
+		}
+	}()
+
+	if err := syscall.Lstat(oldPath, &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	// Renaming a file over a hard link of itself does nothing.
+	replaced = replaced && (targetSt.Dev != st.Dev || targetSt.Ino != st.Ino)
+	differs, err := n.root().policyDiffers(oldPath, &st, oldRelPath, newRelPath)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	if !differs && flags&fs.RENAME_EXCHANGE != 0 {
+		// The destination moves to the source path as well.
+		newSt := syscall.Stat_t{}
+		if err := syscall.Lstat(newPath, &newSt); err != nil {
+			return fs.ToErrno(err)
+		}
+		if differs, err = n.root().policyDiffers(newPath, &newSt, newRelPath, oldRelPath); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	if !differs {
+		return fs.ToErrno(unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, uint(flags)))
+	}
+
+	if n.root().refuseCrossPolicyRename || flags&fs.RENAME_EXCHANGE != 0 ||
+		st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return syscall.EXDEV
+	}
+	if flags&unix.RENAME_NOREPLACE != 0 {
+		if err := syscall.Lstat(newPath, &syscall.Stat_t{}); err == nil {
+			return syscall.EEXIST
+		}
+	}
+
+	var child *ageFSNode
+	if ch := n.GetChild(name); ch != nil {
+		child = ch.Operations().(*ageFSNode)
+		child.mu.Lock()
+		defer child.mu.Unlock()
+		// The shared content would be written back to the new path with
+		// the old policy.
+		if child.content != nil {
+			return syscall.EBUSY
+		}
+	}
+
+	newSt, err := n.root().convertFile(oldPath, oldRelPath, newPath, newRelPath, &st)
+	if newSt != nil && child != nil {
+		n.root().replacedIno(child.EmbeddedInode(), &st, newSt)
+	}
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	return fs.ToErrno(syscall.Unlink(oldPath))
+}
+
+// Link refuses to link a regular file to a path with the other encryption
+// policy, since the content cannot follow both policies.
+func (n *ageFSNode) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if n.isReserved(name) {
+		return nil, syscall.EPERM
+	}
+	targetRelPath := target.EmbeddedInode().Path(nil)
+	relPath := filepath.Join(n.relPath(), name)
+	if target.EmbeddedInode().StableAttr().Mode&syscall.S_IFMT == syscall.S_IFREG &&
+		n.root().shouldEncrypt(targetRelPath) != n.root().shouldEncrypt(relPath) {
+		return nil, syscall.EXDEV
+	}
+
+	if err := n.root().addLongName(n.path(), name); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	p := n.childPath(name)
+	err := syscall.Link(n.root().backingPath(targetRelPath), p)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(p, &st); err != nil {
+		syscall.Unlink(p)
+		return nil, fs.ToErrno(err)
+	}
+
+	out.Attr.FromStat(&st)
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		if n.root().shouldEncrypt(relPath) {
+			err = n.fixAttrSize(relPath, p, &out.Attr.Size)
+		}
+	case syscall.S_IFLNK:
+		err = n.root().fixSymlinkSize(p, &out.Attr.Size)
+	}
+	if err != nil {
+		syscall.Unlink(p)
+		return nil, fs.ToErrno(err)
+	}
+
+	node := n.root().newNode(n.EmbeddedInode(), name, &st)
+	ch := n.root().newInode(ctx, n.EmbeddedInode(), node, &st)
+	return ch, 0
+}
+
+func (n *ageFSNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if n.isReserved(name) {
+		return nil, syscall.EPERM
+	}
+	if err := n.root().addLongName(n.path(), name); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	p := n.childPath(name)
+	if err := syscall.Mknod(p, mode, int(rdev)); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return n.newChild(ctx, name, p, out)
+}
+
+func (n *ageFSNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if n.isReserved(name) {
+		return nil, syscall.EPERM
+	}
+	if err := n.root().addLongName(n.path(), name); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	p := n.childPath(name)
+	if err := os.Mkdir(p, os.FileMode(mode)); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return n.newChild(ctx, name, p, out)
+}
+
+func (n *ageFSNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if n.isReserved(name) {
+		return nil, syscall.EPERM
+	}
+	if err := n.root().addLongName(n.path(), name); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	p := n.childPath(name)
+	diskTarget := target
+	if relPath := filepath.Join(n.relPath(), name); n.root().shouldEncryptMetadata(relPath) {
+		var err error
+		if diskTarget, err = n.root().encryptSymlinkTarget(relPath, target); err != nil {
+			return nil, fs.ToErrno(err)
+		}
+	}
+	if err := syscall.Symlink(diskTarget, p); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	ch, errno := n.newChild(ctx, name, p, out)
+	out.Attr.Size = uint64(len(target))
+	return ch, errno
+}
+
+// newChild returns the inode for the file just created at p as the child
+// named name.
+func (n *ageFSNode) newChild(ctx context.Context, name, p string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	n.preserveOwner(ctx, p)
+	st := syscall.Stat_t{}
+	if err := syscall.Lstat(p, &st); err != nil {
+		os.Remove(p)
+		return nil, fs.ToErrno(err)
+	}
+	out.Attr.FromStat(&st)
+
+	node := n.root().newNode(n.EmbeddedInode(), name, &st)
+	ch := n.root().newInode(ctx, n.EmbeddedInode(), node, &st)
+	return ch, 0
+}
+
+func (n *ageFSNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	if err := syscall.Rmdir(n.childPath(name)); err != nil {
+		return fs.ToErrno(err)
+	}
+	return fs.ToErrno(n.root().removeLongName(n.path(), name))
+}
+
+func (n *ageFSNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	p := n.childPath(name)
+	st := syscall.Stat_t{}
+	statErr := syscall.Lstat(p, &st)
+	if err := syscall.Unlink(p); err != nil {
+		return fs.ToErrno(err)
+	}
+	err := n.root().removeLongName(n.path(), name)
+	if statErr == nil && st.Nlink <= 1 {
+		n.root().removedIno(n.GetChild(name), &st)
+		err = multierr.Append(err, n.root().metadata().forget(&st))
+	}
+	if relPath := filepath.Join(n.relPath(), name); n.root().reloadIgnore && isIgnoreFile(relPath) {
+		// Errors are logged in reloadIgnoreFiles, and the file has been
+		// removed.
+		_ = n.root().reloadIgnoreFiles()
+	}
+	return fs.ToErrno(err)
+}
+
+func (n *ageFSNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	target, err := readlink(n.path())
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	target, err = n.root().decryptSymlinkTarget(target)
+	return target, fs.ToErrno(err)
+}
+
+func (n *ageFSNode) Opendir(ctx context.Context) syscall.Errno {
+	fd, err := syscall.Open(n.path(), syscall.O_DIRECTORY, 0755)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	syscall.Close(fd)
+	return fs.OK
+}
+
+// Readdir lists the entries with their names decrypted if file names are
+// encrypted, leaving out the files which are not shown on the mount.
+func (n *ageFSNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	p := n.path()
+	ds, errno := fs.NewLoopbackDirStream(p)
+	if errno != 0 || n.root().names == nil && !n.IsRoot() {
+		return ds, errno
+	}
+	defer ds.Close()
+
+	var entries []fuse.DirEntry
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			return nil, errno
+		}
+		if e.Name != "." && e.Name != ".." {
+			if n.isReserved(e.Name) {
+				continue
+			}
+			name, ok := n.root().decodeName(p, e.Name)
+			if !ok {
+				continue
+			}
+			e.Name = name
+		}
+		entries = append(entries, e)
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (n *ageFSNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	s := syscall.Statfs_t{}
+	if err := syscall.Statfs(n.path(), &s); err != nil {
+		return fs.ToErrno(err)
+	}
+	out.FromStatfsT(&s)
+	return fs.OK
+}
+
+func (n *ageFSNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if n.root().hidesXattr(attr) {
+		return 0, syscall.ENODATA
+	}
+	if !isUserXattr(attr) {
+		sz, err := unix.Lgetxattr(n.path(), attr, dest)
+		return uint32(sz), fs.ToErrno(err)
+	}
+
+	value, err := lgetxattr(n.path(), attr)
+	if err != nil {
+		return 0, fs.ToErrno(err)
+	}
+	if value, err = n.root().decryptXattrValue(value); err != nil {
+		return 0, fs.ToErrno(err)
+	}
+	return copyXattrResult(dest, value)
+}
+
+func (n *ageFSNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	if n.root().hidesXattr(attr) {
+		return syscall.EPERM
+	}
+	if relPath := n.relPath(); isUserXattr(attr) && n.root().shouldEncryptMetadata(relPath) {
+		var err error
+		if data, err = n.root().encryptXattrValue(relPath, data); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	return fs.ToErrno(unix.Lsetxattr(n.path(), attr, data, int(flags)))
+}
+
+func (n *ageFSNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	if n.root().hidesXattr(attr) {
+		return syscall.EPERM
+	}
+	return fs.ToErrno(unix.Lremovexattr(n.path(), attr))
+}
+
+// Listxattr lists the xattrs leaving out the ones hidden on the mount.
+func (n *ageFSNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	list, err := llistxattr(n.path())
+	if err != nil {
+		return 0, fs.ToErrno(err)
+	}
+	var visible []byte
+	for _, attr := range bytes.SplitAfter(list, []byte{0}) {
+		if len(attr) > 0 && !n.root().hidesXattr(string(attr[:len(attr)-1])) {
+			visible = append(visible, attr...)
+		}
+	}
+	return copyXattrResult(dest, visible)
+}
+
 // preserveOwner sets uid and gid of `path` according to the caller information
 // in `ctx`.
 func (n *ageFSNode) preserveOwner(ctx context.Context, path string) error {
@@ -129,59 +692,101 @@ func (n *ageFSNode) preserveOwner(ctx context.Context, path string) error {
 	return syscall.Lchown(path, int(caller.Uid), int(caller.Gid))
 }
 
-func (n *ageFSNode) fixAttrSize(path string, outSize *uint64) error {
-	sz, err := getXattrDecryptedSize(path)
+// fixAttrSize sets the plaintext size of the encrypted file at path. The
+// size recorded in the xattr is used only if it is authentic and up to date.
+// In reverse mode, it sets the size of the encrypted view of the plaintext
+// file instead, which outSize has on entry.
+func (n *ageFSNode) fixAttrSize(relPath, path string, outSize *uint64) error {
+	if n.root().reverse != nil {
+		sz, err := n.root().reverseSize(relPath, *outSize)
+		if err != nil {
+			return err
+		}
+		*outSize = sz
+		return nil
+	}
+	sz, ok, err := n.root().getXattrDecryptedSize(path)
 	if err != nil {
-		if errors.Is(err, syscall.ENODATA) {
-			sz, err := n.readFileAndSetXattrDecryptedSize(path)
-			if err != nil {
-				return err
-			}
-			*outSize = sz
-			return nil
+		return err
+	}
+	if !ok {
+		if sz, err = n.computeDecryptedSize(path); err != nil {
+			return err
 		}
-		return fs.ToErrno(err)
 	}
 	*outSize = sz
 	return nil
 }
 
-func (n *ageFSNode) readFileAndSetXattrDecryptedSize(path string) (uint64, error) {
+// computeDecryptedSize returns the plaintext size of the encrypted file at
+// path. For binary age files it is derived from the header and the file size
+// without decrypting, and only armored files are decrypted as a whole.
+func (n *ageFSNode) computeDecryptedSize(path string) (uint64, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return 0, err
 	}
 	defer file.Close()
 
-	data, err := readAndDecryptFile(file, n.root().identities)
+	fi, err := file.Stat()
 	if err != nil {
 		return 0, err
 	}
-	sz := uint64(len(data))
+	// A newly created file has no age header yet.
+	if fi.Size() == 0 {
+		return 0, nil
+	}
 
-	if err := setXattrDecryptedSize(path, sz); err != nil {
+	armored, err := ageutil.IsArmored(file)
+	if err != nil {
 		return 0, err
 	}
-	return sz, nil
+	if armored {
+		if n.root().writeOnly() {
+			// The size of an armored file cannot be known without
+			// decrypting it.
+			return 0, nil
+		}
+		return n.readFileAndSetXattrDecryptedSize(path)
+	}
+
+	sz, err := ageutil.PlaintextSize(file, fi.Size())
+	if err != nil {
+		return 0, err
+	}
+	return uint64(sz), nil
 }
 
-func getXattrDecryptedSize(path string) (uint64, error) {
-	var buf [24]byte
-	sz, err := syscall.Getxattr(path, xattrNameDecryptedSize, buf[:])
+func (n *ageFSNode) readFileAndSetXattrDecryptedSize(path string) (uint64, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return 0, err
 	}
-	v, err := strconv.ParseUint(string(buf[:sz]), 10, 64)
+	defer file.Close()
+
+	data, err := readAndDecryptFile(file, n.root().identities)
 	if err != nil {
 		return 0, err
 	}
-	return v, nil
+	sz := uint64(len(data))
+
+	if err := n.root().setXattrDecryptedSize(path, sz); err != nil {
+		return 0, err
+	}
+	return sz, nil
 }
 
-func setXattrDecryptedSize(path string, sz uint64) error {
-	value := strconv.FormatUint(sz, 10)
-	if err := syscall.Setxattr(path, xattrNameDecryptedSize, []byte(value), 0); err != nil {
+// fixSymlinkSize sets the size of the decrypted target of the symlink at
+// path if it is encrypted.
+func (r *ageFSRoot) fixSymlinkSize(path string, outSize *uint64) error {
+	target, err := readlink(path)
+	if err != nil {
 		return err
 	}
+	sz, err := r.symlinkTargetSize(target)
+	if err != nil {
+		return err
+	}
+	*outSize = sz
 	return nil
 }
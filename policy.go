@@ -0,0 +1,203 @@
+package agefs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hnakamur/agefs/internal/ageutil"
+	"go.uber.org/multierr"
+)
+
+// PolicyAction is what is done to a file to make it follow the encryption
+// policy.
+type PolicyAction int
+
+const (
+	// PolicyEncrypt encrypts an unencrypted file at an encrypted path.
+	PolicyEncrypt PolicyAction = iota
+	// PolicyDecrypt decrypts an encrypted file at an unencrypted path.
+	PolicyDecrypt
+	// PolicyRemoveXattr removes the stale xattr of the plaintext size from
+	// an unencrypted file.
+	PolicyRemoveXattr
+)
+
+func (a PolicyAction) String() string {
+	switch a {
+	case PolicyEncrypt:
+		return "encrypt"
+	case PolicyDecrypt:
+		return "decrypt"
+	case PolicyRemoveXattr:
+		return "remove xattr"
+	default:
+		return "unknown"
+	}
+}
+
+// PolicyChange is an action done to the file at Path.
+type PolicyChange struct {
+	Path   string
+	Action PolicyAction
+}
+
+// ApplyPolicy walks the source directory and makes each regular file follow
+// the encryption policy, which may have changed since the file was written.
+// Whether a file is encrypted is determined by the presence of an age
+// header.
+//
+// Age files at unencrypted paths which are named *.age or armored are left
+// as they are, since agefs writes neither and users keep such files on
+// purpose, unless decryptAgeFiles is true.
+//
+// It returns the changes made and the files which could not be changed,
+// for example because none of the identities can decrypt them. If dryRun is
+// true, the changes are reported but not made.
+func (d *SourceDir) ApplyPolicy(dryRun, decryptAgeFiles bool) (changes []PolicyChange, failures []FileFailure, err error) {
+	r := d.root
+	rootPath := r.Path
+
+	type fileID struct{ dev, ino uint64 }
+	seenPolicies := make(map[fileID]bool)
+	walk := func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(rootPath, path)
+		if err != nil {
+			return err
+		}
+		// The policy files are read as they are.
+		if isPolicyFile(relPath) {
+			return nil
+		}
+
+		st := syscall.Stat_t{}
+		if err := syscall.Stat(path, &st); err != nil {
+			return err
+		}
+		// Process a file with hard links only once.
+		id := fileID{dev: uint64(st.Dev), ino: st.Ino}
+		if encrypt, ok := seenPolicies[id]; ok {
+			if encrypt != r.shouldEncrypt(relPath) {
+				failures = append(failures, FileFailure{Path: relPath,
+					Err: errors.New("hard links of the file have different policies")})
+			}
+			return nil
+		}
+		seenPolicies[id] = r.shouldEncrypt(relPath)
+
+		action, ok, err := r.applyPolicy(path, relPath, &st, dryRun, decryptAgeFiles)
+		if err != nil {
+			failures = append(failures, FileFailure{Path: relPath, Err: err})
+			return nil
+		}
+		if ok {
+			changes = append(changes, PolicyChange{Path: relPath, Action: action})
+		}
+		return nil
+	}
+	// Save the sidecar index once after the walk.
+	err = r.metadata().batch(func() error {
+		return filepath.WalkDir(rootPath, walk)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return changes, failures, nil
+}
+
+// applyPolicy makes the file at path follow the policy for relPath. ok is
+// false if the file already follows it or is an age file kept by the user.
+func (r *ageFSRoot) applyPolicy(path, relPath string, st *syscall.Stat_t, dryRun, decryptAgeFiles bool) (action PolicyAction, ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer func() {
+		err = multierr.Append(err, f.Close())
+	}()
+
+	// An empty file is the same whether it is encrypted or not.
+	encrypted := false
+	if st.Size > 0 {
+		if encrypted, err = ageutil.IsEncrypted(f); err != nil {
+			return 0, false, err
+		}
+	}
+
+	var write func(f *os.File) error
+	switch shouldEncrypt := r.shouldEncrypt(relPath); {
+	case shouldEncrypt && !encrypted && st.Size > 0:
+		action = PolicyEncrypt
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return 0, false, err
+		}
+		write = func(f *os.File) error {
+			return r.encryptToFile(f, relPath, data)
+		}
+	case !shouldEncrypt && encrypted:
+		if !decryptAgeFiles {
+			userFile, err := isUserAgeFile(f, relPath)
+			if err != nil || userFile {
+				return 0, false, err
+			}
+		}
+		action = PolicyDecrypt
+		data, err := r.decryptFile(f)
+		if err != nil {
+			return 0, false, err
+		}
+		write = func(f *os.File) error {
+			if _, err := f.Write(data); err != nil {
+				return err
+			}
+			return r.removeXattrDecryptedSize(f.Name())
+		}
+	case !shouldEncrypt:
+		hasXattr, err := r.hasXattrDecryptedSize(path)
+		if err != nil || !hasXattr {
+			return 0, false, err
+		}
+		if !dryRun {
+			if err := r.removeXattrDecryptedSize(path); err != nil {
+				return 0, false, err
+			}
+		}
+		return PolicyRemoveXattr, true, nil
+	default:
+		return 0, false, nil
+	}
+
+	if dryRun {
+		return action, true, nil
+	}
+	if st.Nlink > 1 {
+		// Replacing the file would detach it from its other hard links.
+		err = overwriteFile(path, write)
+	} else {
+		_, err = r.replaceFile(path, int(f.Fd()), st, write)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return action, true, nil
+}
+
+// isUserAgeFile reports whether the age file f at relPath is named *.age or
+// armored, which agefs never writes.
+func isUserAgeFile(f *os.File, relPath string) (bool, error) {
+	if strings.HasSuffix(relPath, ".age") {
+		return true, nil
+	}
+	return ageutil.IsArmored(f)
+}
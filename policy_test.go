@@ -0,0 +1,115 @@
+package agefs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/hnakamur/agefs/internal/ageutil"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writeFile := func(name string, content []byte) {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var encrypted bytes.Buffer
+	if err := encryptTo(&encrypted, []byte("was secret"), []age.Recipient{id.Recipient()}); err != nil {
+		t.Fatal(err)
+	}
+	writeFile("secret.txt", []byte("secret"))
+	writeFile("public.txt", encrypted.Bytes())
+	writeFile("stale.txt", []byte("stale"))
+	if err := syscall.Setxattr(filepath.Join(dir, "stale.txt"), xattrNameDecryptedSize, []byte("5"), 0); err != nil {
+		t.Fatal(err)
+	}
+	writeFile("empty.txt", nil)
+	// Age files kept by the user at unencrypted paths.
+	writeFile("kept.age", encrypted.Bytes())
+	var armored bytes.Buffer
+	aw := armor.NewWriter(&armored)
+	if err := encryptTo(aw, []byte("armored"), []age.Recipient{id.Recipient()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeFile("armored.txt", armored.Bytes())
+	writeFile(RecipientsFilename, []byte("secret.txt "+id.Recipient().String()+"\n"))
+	writeFile(IgnoreFilename, []byte("public.txt\n"))
+
+	shouldEncrypt, err := readIgnorePatterns(strings.NewReader("public.txt\nstale.txt\n*.age\narmored.txt\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewSourceDir(dir, []age.Identity{id}, shouldEncrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "[{public.txt decrypt} {secret.txt encrypt} {stale.txt remove xattr}]"
+	for _, dryRun := range []bool{true, false} {
+		changes, failures, err := d.ApplyPolicy(dryRun, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(failures) > 0 {
+			t.Fatalf("unexpected failures, dryRun=%v, got=%v", dryRun, failures)
+		}
+		if got := fmt.Sprint(changes); got != want {
+			t.Errorf("changes mismatch, dryRun=%v, got=%s, want=%s", dryRun, got, want)
+		}
+	}
+
+	changes, _, err := d.ApplyPolicy(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) > 0 {
+		t.Errorf("got changes after applying policy, got=%v", changes)
+	}
+	for _, name := range []string{"kept.age", "armored.txt"} {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted, err := ageutil.IsEncrypted(f)
+		f.Close()
+		if err != nil || !encrypted {
+			t.Errorf("age file kept by the user must be left as is: %s, err=%v", name, err)
+		}
+	}
+
+	want = "[{armored.txt decrypt} {kept.age decrypt}]"
+	changes, _, err = d.ApplyPolicy(false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(changes); got != want {
+		t.Errorf("changes mismatch with decryptAgeFiles, got=%s, want=%s", got, want)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, RecipientsFilename)); err != nil || !strings.HasPrefix(string(data), "secret.txt ") {
+		t.Errorf("%s must be left as is, got=%q, err=%v", RecipientsFilename, data, err)
+	}
+	for name, want := range map[string]string{"secret.txt": "secret", "public.txt": "was secret"} {
+		got, err := d.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("content mismatch for %s, got=%q, want=%q", name, got, want)
+		}
+	}
+}
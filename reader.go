@@ -0,0 +1,153 @@
+package agefs
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"syscall"
+
+	"filippo.io/age"
+	"github.com/hnakamur/agefs/internal/ageutil"
+	"github.com/hnakamur/agefs/internal/ageutil/stream"
+)
+
+// maxCachedChunks is the number of decrypted chunks kept per file,
+// which is 1 MiB of plaintext.
+const maxCachedChunks = 16
+
+// plaintextReader reads the decrypted content of an encrypted file at
+// arbitrary offsets.
+type plaintextReader interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// newPlaintextReader returns a plaintextReader for the encrypted file opened
+// as fd. Binary age files are decrypted chunk by chunk on demand, while
+// armored files are decrypted into memory as a whole.
+func newPlaintextReader(fd int, identities []age.Identity) (plaintextReader, error) {
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return nil, err
+	}
+	// A newly created or truncated file has no age header yet.
+	if st.Size == 0 {
+		return bytes.NewReader(nil), nil
+	}
+
+	src := fdReaderAt(fd)
+	if len(identities) == 0 {
+		// The file system is write-only, where only an empty plaintext
+		// can be read since it needs no decryption. This lets a file
+		// truncated before it is opened be written again.
+		if sz, err := ageutil.PlaintextSize(src, st.Size); err == nil && sz == 0 {
+			return bytes.NewReader(nil), nil
+		}
+		return nil, syscall.EACCES
+	}
+	armored, err := ageutil.IsArmored(src)
+	if err != nil {
+		return nil, err
+	}
+	if armored {
+		data, err := readAndDecryptFile(io.NewSectionReader(src, 0, st.Size), identities)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+
+	r, err := ageutil.NewDecryptingReaderAt(identities, src, st.Size)
+	if err != nil {
+		return nil, err
+	}
+	return newChunkCache(r, maxCachedChunks), nil
+}
+
+// fdReaderAt implements io.ReaderAt with pread(2) so that it does not
+// move the offset of the file descriptor.
+type fdReaderAt int
+
+func (fd fdReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) {
+		nn, err := syscall.Pread(int(fd), p[n:], off+int64(n))
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return n, err
+		}
+		if nn == 0 {
+			return n, io.EOF
+		}
+		n += nn
+	}
+	return n, nil
+}
+
+// chunkCache keeps the most recently used decrypted chunks of a file.
+type chunkCache struct {
+	r      *stream.ReaderAt
+	max    int
+	lru    *list.List // of *cachedChunk, most recently used first
+	chunks map[int64]*list.Element
+}
+
+type cachedChunk struct {
+	index int64
+	data  []byte
+}
+
+func newChunkCache(r *stream.ReaderAt, max int) *chunkCache {
+	return &chunkCache{
+		r:      r,
+		max:    max,
+		lru:    list.New(),
+		chunks: make(map[int64]*list.Element),
+	}
+}
+
+func (c *chunkCache) Size() int64 {
+	return c.r.Size()
+}
+
+func (c *chunkCache) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) && off < c.r.Size() {
+		chunk, err := c.chunk(off / stream.ChunkSize)
+		if err != nil {
+			return n, err
+		}
+		nn := copy(p[n:], stream.ClampChunk(chunk, off, c.r.Size()))
+		if nn == 0 {
+			// The chunk is shorter than the size implies.
+			return n, io.ErrUnexpectedEOF
+		}
+		n += nn
+		off += int64(nn)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (c *chunkCache) chunk(i int64) ([]byte, error) {
+	if e, ok := c.chunks[i]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*cachedChunk).data, nil
+	}
+
+	data, err := c.r.ReadChunk(i)
+	if err != nil {
+		return nil, err
+	}
+	if c.lru.Len() >= c.max {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.chunks, e.Value.(*cachedChunk).index)
+	}
+	c.chunks[i] = c.lru.PushFront(&cachedChunk{index: i, data: data})
+	return data, nil
+}
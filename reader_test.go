@@ -0,0 +1,80 @@
+package agefs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/hnakamur/agefs/internal/ageutil/stream"
+)
+
+func TestChunkCache(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, 100000)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	var encrypted bytes.Buffer
+	if err := encryptTo(&encrypted, plaintext, []age.Recipient{id.Recipient()}); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	open := func(name string, data []byte) *os.File {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+
+	f := open("file", encrypted.Bytes())
+	pr, err := newPlaintextReader(int(f.Fd()), []age.Identity{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := pr.(*chunkCache)
+	if !ok {
+		t.Fatalf("reader type mismatch, got=%T", pr)
+	}
+	// The cache holds a single chunk, so that chunks are evicted.
+	c.max = 1
+	if c.Size() != int64(len(plaintext)) {
+		t.Errorf("size mismatch, got=%d, want=%d", c.Size(), len(plaintext))
+	}
+	for _, off := range []int{0, stream.ChunkSize - 10, 5, len(plaintext) - 10, len(plaintext)} {
+		buf := make([]byte, 100)
+		n, err := c.ReadAt(buf, int64(off))
+		want := plaintext[off:]
+		if len(want) > len(buf) {
+			want = want[:len(buf)]
+		} else if err != io.EOF {
+			t.Errorf("error mismatch at %d, got=%v, want=%v", off, err, io.EOF)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Errorf("content mismatch at %d", off)
+		}
+	}
+	if c.lru.Len() != 1 {
+		t.Errorf("cached chunks mismatch, got=%d, want=1", c.lru.Len())
+	}
+
+	// A file whose last chunk was cut short must not be read as a shorter
+	// file.
+	truncated := encrypted.Bytes()[:encrypted.Len()-(len(plaintext)-stream.ChunkSize)-11]
+	f = open("truncated", truncated)
+	if _, err := newPlaintextReader(int(f.Fd()), []age.Identity{id}); err == nil {
+		t.Error("got no error for a truncated file")
+	}
+}
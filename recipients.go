@@ -0,0 +1,120 @@
+package agefs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/hnakamur/agefs/internal/ageutil"
+	"go.uber.org/multierr"
+)
+
+// RecipientsFilename is the name of the file in the source directory
+// choosing the recipients of files by their paths. Like the .ageignore
+// files, the files of this name are never encrypted.
+const RecipientsFilename = ".agerecipients"
+
+// RecipientsFunc returns the recipients to encrypt the file at path to, or
+// nil if the default recipients should be used.
+type RecipientsFunc func(path string) []age.Recipient
+
+type recipientsRule struct {
+	pattern    gitignore.Pattern
+	recipients []age.Recipient
+}
+
+// ReadRecipientsFile reads a recipients policy file such as .agerecipients.
+// Each line consists of a gitignore style pattern and a recipient separated
+// by whitespace, and lines with the same pattern add recipients to the rule
+// of its first line. As in gitignore, the last rule which matches the path or
+// one of its parent directories wins.
+//
+//	infra/prod/** age1...
+//	infra/prod/** ssh-ed25519 AAAA... ops@example.com
+//	apps/billing/ age1...
+func ReadRecipientsFile(filename string) (fn RecipientsFunc, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		return readRecipientsRules(nil, filename)
+	}
+	defer func() {
+		err = multierr.Append(err, f.Close())
+	}()
+
+	return readRecipientsRules(f, filename)
+}
+
+func readRecipientsRules(r io.Reader, name string) (fn RecipientsFunc, err error) {
+	var rules []recipientsRule
+	if r != nil {
+		rulesByPattern := make(map[string]int)
+		scanner := bufio.NewScanner(r)
+		var n int
+		for scanner.Scan() {
+			n++
+			s := strings.TrimSpace(scanner.Text())
+			if strings.HasPrefix(s, commentPrefix) || len(s) == 0 {
+				continue
+			}
+			i := strings.IndexAny(s, " \t")
+			if i == -1 {
+				return nil, fmt.Errorf("%q: missing recipient at line %d", name, n)
+			}
+			pattern := s[:i]
+			if strings.HasPrefix(pattern, "!") {
+				return nil, fmt.Errorf("%q: negative pattern is not supported at line %d", name, n)
+			}
+			recipient, err := ageutil.ParseRecipient(strings.TrimSpace(s[i:]))
+			if err != nil {
+				// Hide the error since it might unintentionally leak the
+				// contents of confidential files.
+				return nil, fmt.Errorf("%q: malformed recipient at line %d", name, n)
+			}
+
+			j, ok := rulesByPattern[pattern]
+			if !ok {
+				j = len(rules)
+				rulesByPattern[pattern] = j
+				rules = append(rules, recipientsRule{pattern: gitignore.ParsePattern(pattern, nil)})
+			}
+			rules[j].recipients = append(rules[j].recipients, recipient)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(rules) == 0 {
+		return func(relPath string) []age.Recipient {
+			return nil
+		}, nil
+	}
+
+	return func(relPath string) []age.Recipient {
+		pathComponents := strings.Split(relPath, string(os.PathSeparator))
+		for i := len(rules) - 1; i >= 0; i-- {
+			if matchPathOrParent(rules[i].pattern, pathComponents) {
+				return rules[i].recipients
+			}
+		}
+		return nil
+	}, nil
+}
+
+// matchPathOrParent reports whether p matches the file at pathComponents or
+// one of its parent directories.
+func matchPathOrParent(p gitignore.Pattern, pathComponents []string) bool {
+	for i := 1; i <= len(pathComponents); i++ {
+		if p.Match(pathComponents[:i], i < len(pathComponents)) == gitignore.Exclude {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package agefs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestReadRecipientsRules(t *testing.T) {
+	var keys []string
+	for i := 0; i < 3; i++ {
+		id, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, id.Recipient().String())
+	}
+
+	t.Run("hasContent", func(t *testing.T) {
+		content := fmt.Sprintf(`# ops team
+infra/prod/** %s
+infra/prod/** %s
+# billing team
+apps/billing/ %s
+apps/billing/shared.txt %s
+`, keys[0], keys[1], keys[2], keys[0])
+		fn, err := readRecipientsRules(strings.NewReader(content), ".agerecipients")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testCases := []struct {
+			input string
+			want  []string
+		}{
+			{input: "infra/prod/db/password.txt", want: keys[:2]},
+			{input: "infra/staging/db/password.txt", want: nil},
+			{input: "apps/billing/api.key", want: keys[2:]},
+			{input: "apps/billing/shared.txt", want: keys[:1]},
+			{input: "README.md", want: nil},
+		}
+		for _, tc := range testCases {
+			var got []string
+			for _, r := range fn(tc.input) {
+				got = append(got, r.(*age.X25519Recipient).String())
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("result mismatch for input=%s, got=%v, want=%v", tc.input, got, tc.want)
+			}
+		}
+	})
+	t.Run("noFile", func(t *testing.T) {
+		fn, err := readRecipientsRules(nil, ".agerecipients")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fn("some_filename"); got != nil {
+			t.Errorf("result mismatch, got=%v, want=nil", got)
+		}
+	})
+	t.Run("malformed", func(t *testing.T) {
+		for _, content := range []string{
+			"infra/prod/**\n",
+			"infra/prod/** not-a-recipient\n",
+			"!infra/prod/** " + keys[0] + "\n",
+		} {
+			if _, err := readRecipientsRules(strings.NewReader(content), ".agerecipients"); err == nil {
+				t.Errorf("got no error for content=%q", content)
+			}
+		}
+	})
+}
+
+func TestWithRecipients(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipients := []age.Recipient{id.Recipient(), other.Recipient()}
+	node, err := NewRoot(t.TempDir(), []age.Identity{id}, func(string) bool { return true },
+		WithRecipients(recipients))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := node.(*ageFSNode).root()
+	if got := r.recipientsFor("secret.txt"); fmt.Sprint(got) != fmt.Sprint(recipients) {
+		t.Errorf("result mismatch, got=%v, want=%v", got, recipients)
+	}
+}
+
+func TestWriteOnly(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if _, err := NewRoot(dir, nil, nil); err == nil {
+		t.Error("got no error without identities and recipients")
+	}
+	if _, err := NewRoot(dir, nil, nil, WithRecipients([]age.Recipient{id.Recipient()})); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, plaintext := range []string{"", "secret"} {
+		var buf bytes.Buffer
+		w, err := age.Encrypt(&buf, id.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, plaintext); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "secret.txt")
+		if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+		fd, err := syscall.Open(path, syscall.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := newPlaintextReader(fd, nil)
+		syscall.Close(fd)
+		if plaintext == "" {
+			// An empty file can be loaded to be overwritten.
+			if err != nil {
+				t.Errorf("got error for an empty plaintext: %v", err)
+			} else if r.Size() != 0 {
+				t.Errorf("size mismatch, got=%d, want=0", r.Size())
+			}
+		} else if err != syscall.EACCES {
+			t.Errorf("error mismatch, got=%v, want=%v", err, syscall.EACCES)
+		}
+	}
+}
+
+func TestRecipientsFileNotEncrypted(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	root, err := NewRoot(dir, []age.Identity{id}, func(string) bool { return true }, WithNameEncryption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := context.Background()
+
+	content := "secrets/** " + id.Recipient().String() + "\n"
+	var out fuse.EntryOut
+	_, fh, _, errno := root.(*ageFSNode).Create(ctx, RecipientsFilename, syscall.O_WRONLY|syscall.O_CREAT, 0600, &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f := fh.(*ageFSFile)
+	if _, errno := f.Write(ctx, []byte(content), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno := f.Flush(ctx); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno := f.Release(ctx); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, RecipientsFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("content mismatch, got=%q, want=%q", data, content)
+	}
+	fn, err := ReadRecipientsFile(filepath.Join(dir, RecipientsFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fn("secrets/db.txt"); len(got) != 1 {
+		t.Errorf("recipients mismatch, got=%v", got)
+	}
+}
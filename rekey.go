@@ -0,0 +1,141 @@
+package agefs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hnakamur/agefs/internal/ageutil"
+	"go.uber.org/multierr"
+)
+
+// FileFailure is a file which could not be processed.
+type FileFailure struct {
+	Path string
+	Err  error
+}
+
+// Rekey walks the source directory and re-wraps the file key of each
+// encrypted file to the recipients it would be encrypted to on the mount.
+// Only the age header is rewritten, so the payload is not decrypted.
+//
+// Re-wrapping does not revoke access: a removed recipient who has the file
+// key from an older copy of a file, such as a backup, can still decrypt it.
+// If reencrypt is true, the payload is instead decrypted and encrypted again
+// with a new file key.
+//
+// It returns the relative paths of the rekeyed files and the files which
+// could not be rekeyed, for example because none of the identities can
+// unwrap the file key. If dryRun is true, files are checked but not modified.
+func (d *SourceDir) Rekey(dryRun, reencrypt bool) (rekeyed []string, failures []FileFailure, err error) {
+	r := d.root
+	rootPath := r.Path
+
+	// The key authenticating the decrypted sizes must stay readable with
+	// the new identities.
+	if err := r.rekeySizeKey(dryRun); err != nil {
+		failures = append(failures, FileFailure{Path: ".", Err: fmt.Errorf("rekey %s: %w", xattrNameSizeKey, err)})
+	}
+
+	type fileID struct{ dev, ino uint64 }
+	seen := make(map[fileID]bool)
+	walk := func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(rootPath, path)
+		if err != nil {
+			return err
+		}
+		if !r.shouldEncrypt(relPath) {
+			return nil
+		}
+
+		st := syscall.Stat_t{}
+		if err := syscall.Stat(path, &st); err != nil {
+			return err
+		}
+		// An empty file has no age header yet.
+		if st.Size == 0 {
+			return nil
+		}
+		// Rekey a file with hard links only once.
+		id := fileID{dev: uint64(st.Dev), ino: st.Ino}
+		if seen[id] {
+			return nil
+		}
+		seen[id] = true
+
+		if err := r.rekeyFile(path, relPath, &st, dryRun, reencrypt); err != nil {
+			failures = append(failures, FileFailure{Path: relPath, Err: err})
+			return nil
+		}
+		rekeyed = append(rekeyed, relPath)
+		return nil
+	}
+	// Write the metadata of the files back once after the walk instead of
+	// for each file.
+	err = r.metadata().batch(func() error {
+		return filepath.WalkDir(rootPath, walk)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return rekeyed, failures, nil
+}
+
+func (r *ageFSRoot) rekeyFile(path, relPath string, st *syscall.Stat_t, dryRun, reencrypt bool) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = multierr.Append(err, f.Close())
+	}()
+
+	rekey := ageutil.Rekey
+	if reencrypt {
+		rekey = ageutil.Reencrypt
+	}
+	recipients := r.recipientsFor(relPath)
+	if dryRun {
+		return rekey(io.Discard, f, r.identities, recipients)
+	}
+
+	if st.Nlink > 1 {
+		// Replacing the file would detach it from its other hard links.
+		var buf bytes.Buffer
+		if err := rekey(&buf, f, r.identities, recipients); err != nil {
+			return err
+		}
+		return overwriteFile(path, func(f *os.File) error {
+			_, err := f.Write(buf.Bytes())
+			return err
+		})
+	}
+
+	_, err = r.replaceFile(path, int(f.Fd()), st, func(tmp *os.File) error {
+		bw := bufio.NewWriter(tmp)
+		if err := rekey(bw, f, r.identities, recipients); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		// The plaintext does not change.
+		sz, ok, err := r.getXattrDecryptedSize(path)
+		if err != nil || !ok {
+			return err
+		}
+		return r.setXattrDecryptedSize(tmp.Name(), sz)
+	})
+	return err
+}
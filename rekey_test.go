@@ -0,0 +1,122 @@
+package agefs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/hnakamur/agefs/internal/ageutil"
+)
+
+func TestRekey(t *testing.T) {
+	var ids []*age.X25519Identity
+	for i := 0; i < 3; i++ {
+		id, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	oldID, newID, otherID := ids[0], ids[1], ids[2]
+
+	dir := t.TempDir()
+	writeFile := func(name string, content []byte) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encrypt := func(id *age.X25519Identity, plaintext string) []byte {
+		var buf bytes.Buffer
+		if err := encryptTo(&buf, []byte(plaintext), []age.Recipient{id.Recipient()}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	writeFile("a.txt", encrypt(oldID, "a"))
+	writeFile("sub/b.txt", encrypt(oldID, "b"))
+	writeFile("sub/other.txt", encrypt(otherID, "other"))
+	writeFile("plain/c.txt", []byte("c"))
+
+	shouldEncrypt, err := readIgnorePatterns(strings.NewReader("plain/\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipientsFunc := func(path string) []age.Recipient {
+		return []age.Recipient{newID.Recipient()}
+	}
+	d, err := NewSourceDir(dir, []age.Identity{oldID}, shouldEncrypt, WithRecipientsFunc(recipientsFunc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		rekeyed, failures, err := d.Rekey(dryRun, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := strings.Join(rekeyed, ","), "a.txt,sub/b.txt"; got != want {
+			t.Errorf("rekeyed mismatch, dryRun=%v, got=%s, want=%s", dryRun, got, want)
+		}
+		if len(failures) != 1 || failures[0].Path != "sub/other.txt" {
+			t.Errorf("failures mismatch, dryRun=%v, got=%v", dryRun, failures)
+		}
+
+		decryptWith := newID
+		if dryRun {
+			decryptWith = oldID
+		}
+		for name, want := range map[string]string{"a.txt": "a", "sub/b.txt": "b"} {
+			f, err := os.Open(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := ageutil.NewDecryptingReader([]age.Identity{decryptWith}, f)
+			if err != nil {
+				t.Fatalf("decrypt %s, dryRun=%v: %v", name, dryRun, err)
+			}
+			got, err := io.ReadAll(r)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("content mismatch for %s, got=%q, want=%q", name, got, want)
+			}
+		}
+	}
+	// Re-encrypting changes the payload, so that the file key in older
+	// copies no longer decrypts it.
+	before, err := os.ReadFile(filepath.Join(dir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := NewSourceDir(dir, []age.Identity{newID}, shouldEncrypt, WithRecipientsFunc(recipientsFunc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, failures, err := d2.Rekey(false, true); err != nil || len(failures) != 1 {
+		t.Fatalf("reencrypt failed, failures=%v, err=%v", failures, err)
+	}
+	after, err := os.ReadFile(filepath.Join(dir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.HasSuffix(after, before[len(before)-len("a")-16:]) {
+		t.Error("payload must change on reencrypt")
+	}
+	r, err := ageutil.NewDecryptingReader([]age.Identity{newID}, bytes.NewReader(after))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || string(got) != "a" {
+		t.Errorf("content mismatch after reencrypt, got=%q, err=%v", got, err)
+	}
+}
@@ -0,0 +1,370 @@
+package agefs
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hnakamur/agefs/internal/ageutil"
+	"go.uber.org/multierr"
+	"golang.org/x/sys/unix"
+)
+
+// WithIgnoreFileReload makes the root reload the .ageignore files whenever
+// they are modified through the mount or directly in the source directory.
+// Handles opened before a reload keep the policy they were opened with until
+// they are closed, but writing through them fails with ESTALE once the
+// reload changes whether their files are encrypted.
+//
+// If the source directory cannot be watched, for example because of the
+// limit of inotify(7) watches, a warning is logged and the files are
+// reloaded only on modifications made through the mount.
+func WithIgnoreFileReload() RootOption {
+	return func(r *ageFSRoot) {
+		r.reloadIgnore = true
+	}
+}
+
+// WithRejectUnencrypting makes reloading the .ageignore files fail if the
+// new policy would treat an encrypted file as plaintext. The current policy
+// is kept and the .ageignore files are restored to the contents it was read
+// from, so that the rejected policy does not take effect on the next mount
+// either. Closing an .ageignore file written through the mount fails with
+// EPERM.
+func WithRejectUnencrypting() RootOption {
+	return func(r *ageFSRoot) {
+		r.rejectUnencrypting = true
+	}
+}
+
+// WithLogger sets the logger for messages such as reloading the .ageignore
+// files. Nothing is logged by default.
+func WithLogger(logger *log.Logger) RootOption {
+	return func(r *ageFSRoot) {
+		r.logger = logger
+	}
+}
+
+func (r *ageFSRoot) logf(format string, v ...interface{}) {
+	if r.logger != nil {
+		r.logger.Printf(format, v...)
+	}
+}
+
+// isIgnoreFile reports whether relPath is an .ageignore file.
+func isIgnoreFile(relPath string) bool {
+	return filepath.Base(relPath) == IgnoreFilename
+}
+
+// isPolicyFile reports whether relPath is an .ageignore or .agerecipients
+// file, which are read from the source directory as they are, so they are
+// neither encrypted nor given encrypted names.
+func isPolicyFile(relPath string) bool {
+	name := filepath.Base(relPath)
+	return name == IgnoreFilename || name == RecipientsFilename
+}
+
+// ignoreFileWatcher watches the directories in the source directory with
+// inotify(7) for modifications of the .ageignore files made directly in the
+// source directory.
+type ignoreFileWatcher struct {
+	r    *ageFSRoot
+	fd   int
+	dirs map[int32]string // watch descriptor to directory
+}
+
+// watchIgnoreFiles starts watching the source directory. The watch lasts
+// as long as the process.
+func (r *ageFSRoot) watchIgnoreFiles() error {
+	_, files, err := readIgnoreTree(r.Path, r.decodeName)
+	if err != nil {
+		return err
+	}
+	r.ignoreFiles = files
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		r.logf("watch %s files: %v; they are reloaded only on modifications through the mount", IgnoreFilename, err)
+		return nil
+	}
+	w := &ignoreFileWatcher{r: r, fd: fd, dirs: make(map[int32]string)}
+	if err := w.addTree(r.Path); err != nil {
+		// Keep the watches added so far.
+		r.logf("watch %s files: %v; they are reloaded only on modifications through the mount", IgnoreFilename, err)
+		return nil
+	}
+	r.ignoreWatched.Store(true)
+	go w.run()
+	return nil
+}
+
+// addTree watches dir and its subdirectories.
+func (w *ignoreFileWatcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		const mask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_DELETE
+		wd, err := unix.InotifyAddWatch(w.fd, path, mask)
+		if err != nil {
+			return err
+		}
+		w.dirs[int32(wd)] = path
+		return nil
+	})
+}
+
+func (w *ignoreFileWatcher) run() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := unix.Read(w.fd, buf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			w.r.logf("stop watching %s files: %v", IgnoreFilename, err)
+			w.r.ignoreWatched.Store(false)
+			unix.Close(w.fd)
+			return
+		}
+
+		modified := false
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			start := off + unix.SizeofInotifyEvent
+			end := start + int(ev.Len)
+			off = end
+			name := string(bytes.TrimRight(buf[start:end], "\x00"))
+
+			switch {
+			case ev.Mask&unix.IN_IGNORED != 0:
+				delete(w.dirs, ev.Wd)
+			case ev.Mask&unix.IN_ISDIR == 0:
+				if name == IgnoreFilename && ev.Mask&unix.IN_CREATE == 0 {
+					modified = true
+				}
+			case ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+				if err := w.addTree(filepath.Join(w.dirs[ev.Wd], name)); err != nil {
+					w.r.logf("watch %s: %v", filepath.Join(w.dirs[ev.Wd], name), err)
+					w.r.ignoreWatched.Store(false)
+				}
+				// A directory moved in may have .ageignore files.
+				modified = modified || ev.Mask&unix.IN_MOVED_TO != 0
+			default:
+				// A directory removed or moved out may have had
+				// .ageignore files.
+				modified = true
+			}
+		}
+		if modified {
+			// Errors are logged in reloadIgnoreFiles.
+			_ = w.r.reloadIgnoreFiles()
+		}
+	}
+}
+
+// reloadIgnoreFiles reads the .ageignore files and swaps the policy if
+// they have been modified. It returns EPERM if the new policy is rejected.
+func (r *ageFSRoot) reloadIgnoreFiles() error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	ps, files, err := readIgnoreTree(r.Path, r.decodeName)
+	if err != nil {
+		r.logf("reload %s files: %v", IgnoreFilename, err)
+		return err
+	}
+	if equalIgnoreFiles(files, r.ignoreFiles) {
+		if r.ignoreFilesRejected {
+			return syscall.EPERM
+		}
+		return nil
+	}
+
+	newPolicy := newShouldEncryptFunc(ps)
+	oldPolicy := *r.policy.Load()
+	if r.rejectUnencrypting {
+		relPath, found, err := r.findUnencrypting(oldPolicy, newPolicy)
+		if err != nil {
+			r.logf("reload %s files: %v", IgnoreFilename, err)
+			return err
+		}
+		if found {
+			r.logf("rejected %s files: encrypted file %s would be treated as plaintext", IgnoreFilename, relPath)
+			if err := r.restoreIgnoreFiles(files); err != nil {
+				// Keep rejecting the files on disk until they are
+				// modified again.
+				r.logf("restore %s files: %v", IgnoreFilename, err)
+				r.ignoreFiles = files
+				r.ignoreFilesRejected = true
+			}
+			return syscall.EPERM
+		}
+	}
+	r.ignoreFiles = files
+	r.ignoreFilesRejected = false
+	r.policy.Store(&newPolicy)
+	r.logf("reloaded %s files", IgnoreFilename)
+
+	// The kernel may be waiting for the operation which triggered the
+	// reload, so notify it asynchronously.
+	go r.invalidatePolicyChanges(oldPolicy, newPolicy)
+	return nil
+}
+
+func equalIgnoreFiles(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for relPath, data := range a {
+		if other, ok := b[relPath]; !ok || !bytes.Equal(data, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreIgnoreFiles writes back the .ageignore files the current policy was
+// read from over the rejected files, and removes the ones added since.
+// r.reloadMu must be held.
+func (r *ageFSRoot) restoreIgnoreFiles(files map[string][]byte) error {
+	var restored []string
+	for relPath, data := range r.ignoreFiles {
+		if cur, ok := files[relPath]; ok && bytes.Equal(cur, data) {
+			continue
+		}
+		path := r.backingPath(relPath)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		err = multierr.Append(err, f.Sync())
+		if err = multierr.Append(err, f.Close()); err != nil {
+			return err
+		}
+		restored = append(restored, relPath)
+	}
+	for relPath := range files {
+		if _, ok := r.ignoreFiles[relPath]; ok {
+			continue
+		}
+		if err := os.Remove(r.backingPath(relPath)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		restored = append(restored, relPath)
+	}
+	for _, relPath := range restored {
+		r.logf("restored %s", relPath)
+	}
+
+	// As in reloadIgnoreFiles, the kernel may be waiting for the operation
+	// which triggered the reload.
+	go r.invalidateFiles(restored)
+	return nil
+}
+
+// invalidateFiles makes the kernel drop the cached attributes and contents
+// of the files at relPaths known to it.
+func (r *ageFSRoot) invalidateFiles(relPaths []string) {
+	for _, relPath := range relPaths {
+		var dir *fs.Inode
+		ch := r.rootNode.EmbeddedInode()
+		for _, name := range strings.Split(relPath, string(os.PathSeparator)) {
+			if dir, ch = ch, ch.GetChild(name); ch == nil {
+				break
+			}
+		}
+		if ch == nil {
+			continue
+		}
+		dir.NotifyEntry(filepath.Base(relPath))
+		ch.NotifyContent(0, 0)
+	}
+}
+
+// findUnencrypting returns the relative path of an encrypted file in the
+// source directory which newPolicy would treat as plaintext.
+func (r *ageFSRoot) findUnencrypting(oldPolicy, newPolicy ShouldEncryptFunc) (relPath string, found bool, err error) {
+	errFound := errors.New("found")
+	err = filepath.WalkDir(r.Path, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(r.Path, path)
+		if err != nil {
+			return err
+		}
+		rel, ok := r.decodeRelPath(r.Path, rel)
+		if !ok || isPolicyFile(rel) || !oldPolicy(rel) || newPolicy(rel) {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		encrypted, err := ageutil.IsEncrypted(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if encrypted {
+			relPath = rel
+			return errFound
+		}
+		return nil
+	})
+	if err == errFound {
+		return relPath, true, nil
+	}
+	return "", false, err
+}
+
+// invalidatePolicyChanges makes the kernel look up again the files known
+// to it whose policy differs between oldPolicy and newPolicy, so that their
+// sizes are reported under the new policy.
+func (r *ageFSRoot) invalidatePolicyChanges(oldPolicy, newPolicy ShouldEncryptFunc) {
+	changed := 0
+	var walk func(dir *fs.Inode, dirRelPath string)
+	walk = func(dir *fs.Inode, dirRelPath string) {
+		for name, ch := range dir.Children() {
+			relPath := filepath.Join(dirRelPath, name)
+			if ch.IsDir() {
+				walk(ch, relPath)
+				continue
+			}
+			if ch.Mode()&syscall.S_IFMT != syscall.S_IFREG || isPolicyFile(relPath) {
+				continue
+			}
+			encrypt := newPolicy(relPath)
+			if oldPolicy(relPath) == encrypt {
+				continue
+			}
+			if encrypt {
+				r.logf("%s is now encrypted by policy", relPath)
+			} else {
+				r.logf("%s is now unencrypted by policy", relPath)
+			}
+			dir.NotifyEntry(name)
+			ch.NotifyContent(0, 0)
+			changed++
+		}
+	}
+	walk(r.rootNode.EmbeddedInode(), "")
+	if changed > 0 {
+		r.logf("run agefs apply-policy to convert existing files")
+	}
+}
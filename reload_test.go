@@ -0,0 +1,157 @@
+package agefs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestReloadIgnoreFile(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	var encrypted bytes.Buffer
+	if err := encryptTo(&encrypted, []byte("secret"), []age.Recipient{id.Recipient()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret.txt"), encrypted.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ignoreFilename := filepath.Join(dir, ".ageignore")
+	if err := os.WriteFile(ignoreFilename, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	shouldEncrypt, err := ReadIgnoreFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The watcher is not started, so that it does not restore a rejected
+	// file before the test reloads it.
+	node, err := NewRoot(dir, []age.Identity{id}, shouldEncrypt, WithRejectUnencrypting())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := node.(*ageFSNode).root()
+
+	if r.shouldEncrypt(".ageignore") {
+		t.Error("ignore file must not be encrypted")
+	}
+
+	testCases := []struct {
+		content     string
+		wantErr     error
+		wantContent string
+		wantPlain   []string
+	}{
+		{content: "*.pub\n", wantContent: "*.pub\n", wantPlain: []string{"id.pub"}},
+		{content: "*.pub\nsecret.txt\n", wantErr: syscall.EPERM, wantContent: "*.pub\n", wantPlain: []string{"id.pub"}},
+		{content: "*.pub\nnew.txt\n", wantContent: "*.pub\nnew.txt\n", wantPlain: []string{"id.pub", "new.txt"}},
+	}
+	for _, tc := range testCases {
+		if err := os.WriteFile(ignoreFilename, []byte(tc.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.reloadIgnoreFiles(); err != tc.wantErr {
+			t.Errorf("error mismatch for content=%q, got=%v, want=%v", tc.content, err, tc.wantErr)
+		}
+		// A rejected file is restored, so that it is not used on the next
+		// mount either.
+		if got, err := os.ReadFile(ignoreFilename); err != nil || string(got) != tc.wantContent {
+			t.Errorf("file content mismatch after content=%q, got=%q, err=%v, want=%q", tc.content, got, err, tc.wantContent)
+		}
+		if !r.shouldEncrypt("secret.txt") {
+			t.Errorf("secret.txt is treated as plaintext after content=%q", tc.content)
+		}
+		for _, p := range tc.wantPlain {
+			if r.shouldEncrypt(p) {
+				t.Errorf("%s is treated as encrypted after content=%q", p, tc.content)
+			}
+		}
+	}
+}
+
+func TestReloadIgnoreFileStaleHandles(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, name := range []string{".ageignore", "plain.txt", "secret.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := NewRoot(dir, []age.Identity{id}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.NewNodeFS(root, &fs.Options{})
+	r := root.(*ageFSNode).root()
+	ctx := context.Background()
+	stale := openTestFile(t, root, "plain.txt", syscall.O_RDWR)
+	defer stale.Release(ctx)
+	kept := openTestFile(t, root, "secret.txt", syscall.O_RDWR)
+	defer kept.Release(ctx)
+
+	// Swap the policy as reloadIgnoreFiles does, which would also notify
+	// the kernel of a mounted file system.
+	newPolicy, err := readIgnorePatterns(strings.NewReader("plain.txt\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.policy.Store(&newPolicy)
+
+	if _, errno := stale.Write(ctx, []byte("data"), 0); errno != syscall.ESTALE {
+		t.Errorf("write through a handle whose policy changed: got=%v, want=%v", errno, syscall.ESTALE)
+	}
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: 10}}
+	if errno := stale.Setattr(ctx, in, &fuse.AttrOut{}); errno != syscall.ESTALE {
+		t.Errorf("truncate through a handle whose policy changed: got=%v, want=%v", errno, syscall.ESTALE)
+	}
+	if _, errno := stale.Read(ctx, make([]byte, 10), 0); errno != 0 {
+		t.Errorf("read through a handle whose policy changed: %v", errno)
+	}
+	if _, errno := kept.Write(ctx, []byte("data"), 0); errno != 0 {
+		t.Errorf("write through a handle whose policy is kept: %v", errno)
+	}
+}
+
+func TestReloadIgnoreFileOnUnlink(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".ageignore"), []byte("plain.txt\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewRoot(dir, []age.Identity{id}, nil, WithIgnoreFileReload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.NewNodeFS(root, &fs.Options{})
+	r := root.(*ageFSNode).root()
+	if r.shouldEncrypt("plain.txt") {
+		t.Fatal("plain.txt is treated as encrypted")
+	}
+	// Removing an .ageignore file through the mount reloads the policy
+	// even if the source directory is not watched.
+	r.ignoreWatched.Store(false)
+	if errno := root.(*ageFSNode).Unlink(context.Background(), ".ageignore"); errno != 0 {
+		t.Fatal(errno)
+	}
+	if !r.shouldEncrypt("plain.txt") {
+		t.Error("plain.txt is treated as plaintext after its .ageignore file is removed")
+	}
+}
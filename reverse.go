@@ -0,0 +1,433 @@
+package agefs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"filippo.io/age"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hnakamur/agefs/internal/ageutil"
+	"go.uber.org/multierr"
+)
+
+// reverseStateFilename is the name of the file in the root of the source
+// directory which keeps the keys of reverse mode, so that the ciphertext
+// does not change across mounts. It is hidden on the mount.
+const reverseStateFilename = ".agefs-reverse"
+
+// WithReverse makes the root present the plaintext files at encrypted paths
+// of the source directory as age files encrypted on the fly, so that the
+// mount can be backed up to untrusted storage. The mount must be read-only.
+//
+// The ciphertext of a file depends only on its content and recipients, so
+// an unchanged file reads the same across reads and mounts, and files with
+// the same content and recipients have the same ciphertext. A file which is
+// modified while it is read fails with EIO.
+func WithReverse() RootOption {
+	return func(r *ageFSRoot) {
+		r.reverseMode = true
+	}
+}
+
+// reverseState keeps the keys to encrypt files in reverse mode. The files
+// encrypted to the same recipients share a file key and header, and are
+// encrypted with a payload nonce derived from their content, which makes
+// the ciphertext deterministic without reusing a nonce for different
+// plaintexts.
+type reverseState struct {
+	rootPath string
+	logf     func(format string, v ...interface{})
+
+	// mu protects the fields below.
+	mu sync.Mutex
+	// nonceKey is the key of the MAC deriving payload nonces.
+	nonceKey []byte
+	// keys holds the keys of recipients with a fingerprint, which are
+	// saved in the state file.
+	keys map[string]*reverseKey
+	// ephemeralKeys holds the keys of recipients without a fingerprint,
+	// which are generated again on each mount.
+	ephemeralKeys map[ephemeralKeyID]*reverseKey
+	// nonces caches the payload nonces of files.
+	nonces map[reverseNonceID]reverseNonce
+	// readOnly is true if the state file cannot be saved.
+	readOnly bool
+}
+
+type reverseKey struct {
+	fileKey []byte
+	header  []byte
+}
+
+// ephemeralKeyID identifies a recipients slice returned by recipientsFor,
+// which are the same for the paths with the same recipients.
+type ephemeralKeyID struct {
+	first *age.Recipient
+	n     int
+}
+
+type reverseNonceID struct {
+	dev uint64
+	ino uint64
+}
+
+type reverseNonce struct {
+	st    syscall.Stat_t
+	nonce []byte
+}
+
+// openReverseState loads the state file in rootPath, creating it if it does
+// not exist. If the state cannot be saved, such as in a read-only source
+// directory, the keys are kept in memory only.
+func openReverseState(rootPath string, logf func(format string, v ...interface{})) (*reverseState, error) {
+	s := &reverseState{
+		rootPath:      rootPath,
+		logf:          logf,
+		keys:          make(map[string]*reverseKey),
+		ephemeralKeys: make(map[ephemeralKeyID]*reverseKey),
+		nonces:        make(map[reverseNonceID]reverseNonce),
+	}
+	err := s.modify(func() error {
+		if s.nonceKey != nil {
+			return errNotModified
+		}
+		s.nonceKey = make([]byte, 32)
+		_, err := rand.Read(s.nonceKey)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// errNotModified tells modify that the state need not be saved.
+var errNotModified = errors.New("not modified")
+
+// modify applies fn to the state read again from the state file, and saves
+// it unless fn returns errNotModified. The source directory is locked with
+// flock(2) meanwhile, so that mounts of the same directory agree on the
+// keys. s.mu must be held if s is shared.
+func (s *reverseState) modify(fn func() error) (err error) {
+	if s.readOnly {
+		if err := fn(); err != nil && err != errNotModified {
+			return err
+		}
+		return nil
+	}
+
+	dir, err := os.Open(s.rootPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = multierr.Append(err, dir.Close())
+	}()
+	if err := syscall.Flock(int(dir.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		if err == errNotModified {
+			return nil
+		}
+		return err
+	}
+	if err := s.save(); err != nil {
+		if !errors.Is(err, syscall.EROFS) && !errors.Is(err, syscall.EACCES) && !errors.Is(err, syscall.EPERM) {
+			return err
+		}
+		s.logf("cannot save %s, ciphertext will change on the next mount: %v", reverseStateFilename, err)
+		s.readOnly = true
+	}
+	return nil
+}
+
+// load reads the state file, keeping the keys already in memory.
+func (s *reverseState) load() (err error) {
+	f, err := os.Open(filepath.Join(s.rootPath, reverseStateFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer func() {
+		err = multierr.Append(err, f.Close())
+	}()
+
+	// The first line has the nonce key, and each of the other lines has
+	// the fingerprint of recipients, the file key and the header encrypted
+	// to them, all but the fingerprint base64 encoded.
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		invalid := fmt.Errorf("invalid line %d in %s", n, reverseStateFilename)
+		fields := strings.Fields(scanner.Text())
+		if n == 1 {
+			if len(fields) != 1 {
+				return invalid
+			}
+			if s.nonceKey, err = base64.StdEncoding.DecodeString(fields[0]); err != nil {
+				return invalid
+			}
+			continue
+		}
+		if len(fields) != 3 {
+			return invalid
+		}
+		fileKey, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return invalid
+		}
+		hdr, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			return invalid
+		}
+		if _, ok := s.keys[fields[0]]; !ok {
+			s.keys[fields[0]] = &reverseKey{fileKey: fileKey, header: hdr}
+		}
+	}
+	return scanner.Err()
+}
+
+// save replaces the state file with the state.
+func (s *reverseState) save() (err error) {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, base64.StdEncoding.EncodeToString(s.nonceKey))
+	for fp, k := range s.keys {
+		fmt.Fprintln(&buf, fp, base64.StdEncoding.EncodeToString(k.fileKey), base64.StdEncoding.EncodeToString(k.header))
+	}
+
+	tmp, err := os.CreateTemp(s.rootPath, reverseStateFilename+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.rootPath, reverseStateFilename)); err != nil {
+		return err
+	}
+	return syncDir(s.rootPath)
+}
+
+// key returns the file key and header for recipients, generating them on
+// first use.
+func (s *reverseState) key(recipients []age.Recipient) (*reverseKey, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients specified")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fp, ok := ageutil.RecipientsFingerprint(recipients)
+	if !ok {
+		id := ephemeralKeyID{first: &recipients[0], n: len(recipients)}
+		if k, ok := s.ephemeralKeys[id]; ok {
+			return k, nil
+		}
+		k, err := newReverseKey(recipients)
+		if err != nil {
+			return nil, err
+		}
+		s.ephemeralKeys[id] = k
+		return k, nil
+	}
+
+	if k, ok := s.keys[fp]; ok {
+		return k, nil
+	}
+	var k *reverseKey
+	err := s.modify(func() error {
+		var ok bool
+		if k, ok = s.keys[fp]; ok {
+			return errNotModified
+		}
+		var err error
+		if k, err = newReverseKey(recipients); err != nil {
+			return err
+		}
+		s.keys[fp] = k
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func newReverseKey(recipients []age.Recipient) (*reverseKey, error) {
+	fileKey := make([]byte, ageutil.FileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+	hdr, err := ageutil.NewHeader(fileKey, recipients)
+	if err != nil {
+		return nil, err
+	}
+	return &reverseKey{fileKey: fileKey, header: hdr}, nil
+}
+
+// nonce returns the payload nonce for the content of the file opened as fd,
+// which is the MAC of the content.
+func (s *reverseState) nonce(fd int) ([]byte, *syscall.Stat_t, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return nil, nil, err
+	}
+	id := reverseNonceID{dev: uint64(st.Dev), ino: st.Ino}
+	s.mu.Lock()
+	cached, ok := s.nonces[id]
+	s.mu.Unlock()
+	if ok && sameContentStat(&cached.st, &st) {
+		return cached.nonce, &st, nil
+	}
+
+	m := hmac.New(sha256.New, s.nonceKey)
+	if _, err := io.Copy(m, io.NewSectionReader(fdReaderAt(fd), 0, st.Size)); err != nil {
+		return nil, nil, err
+	}
+	if err := checkUnchanged(fd, &st); err != nil {
+		return nil, nil, err
+	}
+	nonce := m.Sum(nil)[:ageutil.PayloadNonceSize]
+
+	s.mu.Lock()
+	s.nonces[id] = reverseNonce{st: st, nonce: nonce}
+	s.mu.Unlock()
+	return nonce, &st, nil
+}
+
+// sameContentStat reports whether st1 and st2 are the stats of the same
+// file with the same content, as far as their timestamps tell.
+func sameContentStat(st1, st2 *syscall.Stat_t) bool {
+	return st1.Dev == st2.Dev && st1.Ino == st2.Ino && st1.Size == st2.Size &&
+		st1.Mtim == st2.Mtim && st1.Ctim == st2.Ctim
+}
+
+// checkUnchanged fails with EIO if the file opened as fd has been modified
+// since it had st.
+func checkUnchanged(fd int, st *syscall.Stat_t) error {
+	var st2 syscall.Stat_t
+	if err := syscall.Fstat(fd, &st2); err != nil {
+		return err
+	}
+	if !sameContentStat(st, &st2) {
+		return syscall.EIO
+	}
+	return nil
+}
+
+// reverseSize returns the size of the encrypted view of the plaintext file
+// at relPath of size bytes.
+func (r *ageFSRoot) reverseSize(relPath string, size uint64) (uint64, error) {
+	k, err := r.reverse.key(r.recipientsFor(relPath))
+	if err != nil {
+		return 0, err
+	}
+	return uint64(ageutil.EncryptedSize(k.header, int64(size))), nil
+}
+
+// reverseFile is a file handle reading the encrypted view of a plaintext
+// file in reverse mode.
+type reverseFile struct {
+	mu   sync.Mutex
+	fd   int
+	node *ageFSNode
+	st   syscall.Stat_t
+	r    *ageutil.EncryptingReaderAt
+}
+
+var _ = (fs.FileHandle)((*reverseFile)(nil))
+
+var _ = (fs.FileReleaser)((*reverseFile)(nil))
+var _ = (fs.FileGetattrer)((*reverseFile)(nil))
+var _ = (fs.FileReader)((*reverseFile)(nil))
+
+// newReverseFile returns a file handle for fd, which is the plaintext file
+// at relPath opened for node.
+func newReverseFile(fd int, relPath string, node *ageFSNode) (*reverseFile, error) {
+	root := node.root()
+	k, err := root.reverse.key(root.recipientsFor(relPath))
+	if err != nil {
+		return nil, err
+	}
+	nonce, st, err := root.reverse.nonce(fd)
+	if err != nil {
+		return nil, err
+	}
+	r, err := ageutil.NewEncryptingReaderAt(k.header, k.fileKey, nonce, fdReaderAt(fd), st.Size)
+	if err != nil {
+		return nil, err
+	}
+	return &reverseFile{fd: fd, node: node, st: *st, r: r}, nil
+}
+
+func (f *reverseFile) Read(ctx context.Context, buf []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.r.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		return nil, fs.ToErrno(err)
+	}
+	// Do not return a chunk encrypted from a modified plaintext, since
+	// its nonce was derived from the old one.
+	if err := checkUnchanged(f.fd, &f.st); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return fuse.ReadResultData(buf[:n]), fs.OK
+}
+
+func (f *reverseFile) Release(ctx context.Context) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fd != -1 {
+		err := syscall.Close(f.fd)
+		f.fd = -1
+		return fs.ToErrno(err)
+	}
+	return syscall.EBADF
+}
+
+func (f *reverseFile) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(f.fd, &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	a.FromStat(&st)
+	a.Ino = f.node.StableAttr().Ino
+	a.Size = uint64(f.r.Size())
+	return fs.OK
+}
@@ -0,0 +1,85 @@
+package agefs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestReverse(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "copy.txt"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	readEncrypted := func(relPath string) []byte {
+		node, err := NewRoot(dir, []age.Identity{id}, nil, WithReverse())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := node.(*ageFSNode).root()
+		fd, err := syscall.Open(filepath.Join(dir, relPath), syscall.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := newReverseFile(fd, relPath, r.rootNode)
+		if err != nil {
+			syscall.Close(fd)
+			t.Fatal(err)
+		}
+		defer f.Release(context.Background())
+
+		encrypted, err := io.ReadAll(io.NewSectionReader(f.r, 0, f.r.Size()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sz, err := r.reverseSize(relPath, uint64(len("secret")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sz != uint64(len(encrypted)) {
+			t.Errorf("size mismatch for %s, got=%d, want=%d", relPath, sz, len(encrypted))
+		}
+		return encrypted
+	}
+
+	encrypted := readEncrypted("secret.txt")
+	decrypted, err := readAndDecryptFile(bytes.NewReader(encrypted), []age.Identity{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != "secret" {
+		t.Errorf("plaintext mismatch, got=%q, want=%q", decrypted, "secret")
+	}
+	if !bytes.Equal(readEncrypted("secret.txt"), encrypted) {
+		t.Error("ciphertext must not change across mounts")
+	}
+	if !bytes.Equal(readEncrypted("copy.txt"), encrypted) {
+		t.Error("ciphertext must depend only on the content and recipients")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("SECRET"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modified := readEncrypted("secret.txt")
+	if bytes.Equal(modified[len(modified)-len("secret")-16:], encrypted[len(encrypted)-len("secret")-16:]) {
+		t.Error("payload must change with the content")
+	}
+
+	if !isReservedPath(reverseStateFilename) {
+		t.Errorf("%s must be hidden on the mount", reverseStateFilename)
+	}
+}
@@ -1,6 +1,11 @@
 package agefs
 
 import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"filippo.io/age"
@@ -10,14 +15,101 @@ import (
 
 type ShouldEncryptFunc func(path string) bool
 
+// RootOption is the option type for [NewRoot].
+type RootOption func(r *ageFSRoot)
+
+// WithRecipientsFunc sets a function to choose recipients per path. The
+// recipients of the identities are used for paths it returns nil for.
+func WithRecipientsFunc(fn RecipientsFunc) RootOption {
+	return func(r *ageFSRoot) {
+		r.recipientsFunc = fn
+	}
+}
+
+// WithRecipients sets the recipients to encrypt files to, instead of the
+// recipients of the identities. The recipients chosen by the function set
+// with WithRecipientsFunc take precedence over them.
+func WithRecipients(recipients []age.Recipient) RootOption {
+	return func(r *ageFSRoot) {
+		r.recipients = recipients
+	}
+}
+
+// WithRefuseCrossPolicyRename makes renaming a file to a path with the other
+// encryption policy fail with EXDEV instead of converting its content.
+// Programs such as mv(1) then fall back to copying through the mount.
+func WithRefuseCrossPolicyRename() RootOption {
+	return func(r *ageFSRoot) {
+		r.refuseCrossPolicyRename = true
+	}
+}
+
 type ageFSRoot struct {
 	fs.LoopbackRoot
-	identities    []age.Identity
-	recipients    []age.Recipient
-	shouldEncrypt ShouldEncryptFunc
+	identities     []age.Identity
+	recipients     []age.Recipient
+	recipientsFunc RecipientsFunc
+
+	// policy is the ShouldEncryptFunc in use, which is swapped when the
+	// .ageignore files are reloaded.
+	policy             atomic.Pointer[ShouldEncryptFunc]
+	reloadIgnore       bool
+	rejectUnencrypting bool
+	// ignoreWatched is set while the whole source directory is watched
+	// for modifications of the .ageignore files.
+	ignoreWatched atomic.Bool
+	logger        *log.Logger
+	// reloadMu serializes reloading the .ageignore files and protects
+	// ignoreFiles and ignoreFilesRejected.
+	reloadMu            sync.Mutex
+	ignoreFiles         map[string][]byte
+	ignoreFilesRejected bool
+	rootNode            *ageFSNode
+
+	refuseCrossPolicyRename bool
+
+	encryptNames         bool
+	encryptMetadata      bool
+	exposeInternalXattrs bool
+	// names encrypts file names if it is not nil.
+	names *nameCipher
+
+	sizeKeyOnce sync.Once
+	sizeKey     []byte
+
+	metadataBackend MetadataBackend
+	metadataStore   metadataStore
+
+	reverseMode bool
+	// reverse keeps the keys to encrypt files in reverse mode.
+	reverse *reverseState
+
+	// inoMu protects the fields below.
+	inoMu sync.Mutex
+	// inoAliases maps the backing inode number of a file to its inode on
+	// the mount if the inode has another StableAttr, such as a file that
+	// replaced another one on save and took over its inode on the mount.
+	inoAliases map[uint64]*fs.Inode
+	// inoDisplaced maps an inode number to the inodes on the mount which
+	// have it but whose files are no longer at the backing inode, so that
+	// a new file reusing the number gets another generation while they are
+	// known to the kernel.
+	inoDisplaced map[uint64][]*fs.Inode
+	// inoGen is the last generation given to a file reusing an inode
+	// number, and inoSweepAt is the number of entries in the maps above at
+	// which the forgotten inodes are dropped from them.
+	inoGen     uint64
+	inoSweepAt int
 }
 
-func NewRoot(rootPath string, identities []age.Identity, shouldEncrypt ShouldEncryptFunc) (fs.InodeEmbedder, error) {
+// NewRoot returns the root of a file system mirroring rootPath. If
+// shouldEncrypt is nil, the policy is read from the .ageignore files in
+// rootPath as with [ReadIgnoreFiles].
+//
+// If identities is empty, the recipients must be set with WithRecipients and
+// the file system is write-only: encrypted files can be created and
+// overwritten as a whole, but reading them fails with EACCES.
+func NewRoot(rootPath string, identities []age.Identity, shouldEncrypt ShouldEncryptFunc, opts ...RootOption) (fs.InodeEmbedder, error) {
 	recipients, err := ageutil.IdentitiesToRecipients(identities)
 	if err != nil {
 		return nil, err
@@ -42,12 +134,53 @@ func NewRoot(rootPath string, identities []age.Identity, shouldEncrypt ShouldEnc
 				return n
 			},
 		},
-		identities:    identities,
-		recipients:    recipients,
-		shouldEncrypt: shouldEncrypt,
+		identities:   identities,
+		recipients:   recipients,
+		inoAliases:   make(map[uint64]*fs.Inode),
+		inoDisplaced: make(map[uint64][]*fs.Inode),
+	}
+	for _, opt := range opts {
+		opt(root)
 	}
+	if len(root.recipients) == 0 {
+		return nil, errors.New("no identities or recipients specified")
+	}
+	if root.writeOnly() && root.encryptNames {
+		return nil, errors.New("encrypting names is not supported without identities")
+	}
+	if root.reverseMode {
+		if root.encryptNames || root.encryptMetadata {
+			return nil, errors.New("encrypting names or metadata is not supported in reverse mode")
+		}
+		if root.reverse, err = openReverseState(rootPath, root.logf); err != nil {
+			return nil, err
+		}
+	}
+	if root.metadataStore, err = openMetadataStore(rootPath, root.metadataBackend); err != nil {
+		return nil, err
+	}
+	if root.encryptNames {
+		if root.names, err = loadNameCipher(rootPath, identities, root.recipientsFor(nameKeyFilename)); err != nil {
+			return nil, err
+		}
+	}
+	if shouldEncrypt == nil {
+		ps, _, err := readIgnoreTree(rootPath, root.decodeName)
+		if err != nil {
+			return nil, err
+		}
+		shouldEncrypt = newShouldEncryptFunc(ps)
+	}
+	root.policy.Store(&shouldEncrypt)
 
-	return root.newNode(nil, "", &st), nil
+	rootNode := root.newNode(nil, "", &st)
+	root.rootNode = rootNode.(*ageFSNode)
+	if root.reloadIgnore {
+		if err := root.watchIgnoreFiles(); err != nil {
+			return nil, err
+		}
+	}
+	return rootNode, nil
 }
 
 func (r *ageFSRoot) newNode(parent *fs.Inode, name string, st *syscall.Stat_t) fs.InodeEmbedder {
@@ -61,7 +194,162 @@ func (r *ageFSRoot) newNode(parent *fs.Inode, name string, st *syscall.Stat_t) f
 	}
 }
 
-func (r *ageFSRoot) idFromStat(st *syscall.Stat_t) fs.StableAttr {
+// shouldEncrypt reports whether the file at relPath should be encrypted
+// under the current policy. The .ageignore and .agerecipients files are
+// never encrypted so that they can be read before the policy is known, and
+// neither are the files agefs uses itself.
+func (r *ageFSRoot) shouldEncrypt(relPath string) bool {
+	return shouldEncryptWith(*r.policy.Load(), relPath)
+}
+
+// shouldEncryptWith is like ageFSRoot.shouldEncrypt but under policy.
+func shouldEncryptWith(policy ShouldEncryptFunc, relPath string) bool {
+	if isPolicyFile(relPath) || isReservedPath(relPath) {
+		return false
+	}
+	return policy(relPath)
+}
+
+// recipientsFor returns the recipients to encrypt the file at relPath to.
+func (r *ageFSRoot) recipientsFor(relPath string) []age.Recipient {
+	if r.recipientsFunc != nil {
+		if recipients := r.recipientsFunc(relPath); len(recipients) > 0 {
+			return recipients
+		}
+	}
+	return r.recipients
+}
+
+// writeOnly reports whether the root has no identities to decrypt files
+// with.
+func (r *ageFSRoot) writeOnly() bool {
+	return len(r.identities) == 0
+}
+
+// minInoSweep is the number of entries in the inode maps of the root below
+// which the forgotten inodes are not dropped from them.
+const minInoSweep = 64
+
+// newInode returns the inode on the mount for the file with st, whose
+// operations are node if it is new. go-fuse v2.5 does not tell when an inode
+// is forgotten, so the forgotten inodes are dropped from the maps as they
+// are found.
+func (r *ageFSRoot) newInode(ctx context.Context, parent *fs.Inode, node fs.InodeEmbedder, st *syscall.Stat_t) *fs.Inode {
+	ino := r.backingIno(st)
+
+	r.inoMu.Lock()
+	defer r.inoMu.Unlock()
+	if alias, ok := r.inoAliases[ino]; ok {
+		if !alias.Forgotten() {
+			id := alias.StableAttr()
+			id.Mode = uint32(st.Mode)
+			return parent.NewInode(ctx, node, id)
+		}
+		delete(r.inoAliases, ino)
+	}
+	id := fs.StableAttr{
+		Mode: uint32(st.Mode),
+		Gen:  1,
+		Ino:  ino,
+	}
+	if !r.liveDisplaced(ino) {
+		return parent.NewInode(ctx, node, id)
+	}
+	r.inoGen++
+	id.Gen = 1 + r.inoGen
+	ch := parent.NewInode(ctx, node, id)
+	r.inoAliases[ino] = ch
+	return ch
+}
+
+// liveDisplaced reports whether an inode displaced from ino is still known
+// to the kernel. r.inoMu must be held.
+func (r *ageFSRoot) liveDisplaced(ino uint64) bool {
+	live := r.inoDisplaced[ino][:0]
+	for _, ch := range r.inoDisplaced[ino] {
+		if !ch.Forgotten() {
+			live = append(live, ch)
+		}
+	}
+	if len(live) == 0 {
+		delete(r.inoDisplaced, ino)
+		return false
+	}
+	r.inoDisplaced[ino] = live
+	return true
+}
+
+// displace records that the file of ch is no longer at the backing inode
+// with its inode number. r.inoMu must be held.
+func (r *ageFSRoot) displace(ch *fs.Inode) {
+	ino := ch.StableAttr().Ino
+	for _, other := range r.inoDisplaced[ino] {
+		if other == ch {
+			return
+		}
+	}
+	r.inoDisplaced[ino] = append(r.inoDisplaced[ino], ch)
+}
+
+// replacedIno records that the file with oldSt, whose inode on the mount is
+// ch, was replaced by the file with newSt.
+func (r *ageFSRoot) replacedIno(ch *fs.Inode, oldSt, newSt *syscall.Stat_t) {
+	oldIno := r.backingIno(oldSt)
+	newIno := r.backingIno(newSt)
+
+	r.inoMu.Lock()
+	defer r.inoMu.Unlock()
+	if r.inoAliases[oldIno] == ch {
+		delete(r.inoAliases, oldIno)
+	}
+	r.inoAliases[newIno] = ch
+	if ch.StableAttr().Ino != newIno {
+		r.displace(ch)
+	}
+	r.sweepInos()
+}
+
+// removedIno records that the file with st, whose inode on the mount is ch
+// or nil if it is not known to the kernel, was removed from the backing
+// file system, which may reuse its inode number.
+func (r *ageFSRoot) removedIno(ch *fs.Inode, st *syscall.Stat_t) {
+	ino := r.backingIno(st)
+
+	r.inoMu.Lock()
+	defer r.inoMu.Unlock()
+	if alias, ok := r.inoAliases[ino]; ok {
+		delete(r.inoAliases, ino)
+		if ch == nil {
+			ch = alias
+		}
+	}
+	if ch != nil && !ch.Forgotten() {
+		r.displace(ch)
+	}
+	r.sweepInos()
+}
+
+// sweepInos drops the forgotten inodes from the maps once they have grown
+// to twice the size after the last sweep. r.inoMu must be held.
+func (r *ageFSRoot) sweepInos() {
+	if len(r.inoAliases)+len(r.inoDisplaced) < r.inoSweepAt {
+		return
+	}
+	for ino, ch := range r.inoAliases {
+		if ch.Forgotten() {
+			delete(r.inoAliases, ino)
+		}
+	}
+	for ino := range r.inoDisplaced {
+		r.liveDisplaced(ino)
+	}
+	r.inoSweepAt = 2 * (len(r.inoAliases) + len(r.inoDisplaced))
+	if r.inoSweepAt < minInoSweep {
+		r.inoSweepAt = minInoSweep
+	}
+}
+
+func (r *ageFSRoot) backingIno(st *syscall.Stat_t) uint64 {
 	// We compose an inode number by the underlying inode, and
 	// mixing in the device number. In traditional filesystems,
 	// the inode numbers are small. The device numbers are also
@@ -71,11 +359,7 @@ func (r *ageFSRoot) idFromStat(st *syscall.Stat_t) fs.StableAttr {
 	// the underlying filesystem
 	swapped := (uint64(st.Dev) << 32) | (uint64(st.Dev) >> 32)
 	swappedRootDev := (r.Dev << 32) | (r.Dev >> 32)
-	return fs.StableAttr{
-		Mode: uint32(st.Mode),
-		Gen:  1,
-		// This should work well for traditional backing FSes,
-		// not so much for other go-fuse FS-es
-		Ino: (swapped ^ swappedRootDev) ^ st.Ino,
-	}
+	// This should work well for traditional backing FSes,
+	// not so much for other go-fuse FS-es
+	return (swapped ^ swappedRootDev) ^ st.Ino
 }
@@ -0,0 +1,106 @@
+package agefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestInodeReuse(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "old.txt"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewRoot(dir, []age.Identity{id}, func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.NewNodeFS(root, &fs.Options{})
+	ctx := context.Background()
+	r := root.(*ageFSNode).root()
+	rootInode := root.EmbeddedInode()
+
+	// lookup returns the StableAttr of a file with st as the child named
+	// name, which the bridge of a mounted file system would add unless it
+	// knows the inode already.
+	lookup := func(name string, st *syscall.Stat_t) fs.StableAttr {
+		ch := r.newInode(ctx, rootInode, r.newNode(rootInode, name, st), st)
+		if known := rootInode.GetChild(name); known == nil || known.StableAttr() != ch.StableAttr() {
+			rootInode.AddChild(name, ch, true)
+		}
+		return ch.StableAttr()
+	}
+	var out fuse.EntryOut
+	old, errno := root.(*ageFSNode).Lookup(ctx, "old.txt", &out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rootInode.AddChild("old.txt", old, false)
+	var oldSt syscall.Stat_t
+	if err := syscall.Lstat(filepath.Join(dir, "old.txt"), &oldSt); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is saved to another backing inode, keeping its inode on the
+	// mount, and then removed while the kernel still knows it.
+	savedSt := oldSt
+	savedSt.Ino += 1000
+	r.replacedIno(old, &oldSt, &savedSt)
+	if got := lookup("old.txt", &savedSt); got != old.StableAttr() {
+		t.Errorf("inode mismatch after save, got=%v, want=%v", got, old.StableAttr())
+	}
+	if err := os.Rename(filepath.Join(dir, "old.txt"), filepath.Join(dir, "saved.txt")); err != nil {
+		t.Fatal(err)
+	}
+	r.removedIno(old, &savedSt)
+
+	// New files reusing either backing inode number must not get the inode
+	// of the removed file.
+	if got := lookup("new.txt", &savedSt); got == old.StableAttr() {
+		t.Errorf("new file reusing the saved inode number got the old inode %v", got)
+	}
+	reused := lookup("reused.txt", &oldSt)
+	if reused == old.StableAttr() {
+		t.Errorf("new file reusing the old inode number got the old inode %v", reused)
+	}
+	if got := lookup("reused.txt", &oldSt); got != reused {
+		t.Errorf("inode mismatch for the same file, got=%v, want=%v", got, reused)
+	}
+
+	// Unlinking through the mount displaces the inode too.
+	if err := os.WriteFile(filepath.Join(dir, "unlinked.txt"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var unlinkedSt syscall.Stat_t
+	if err := syscall.Lstat(filepath.Join(dir, "unlinked.txt"), &unlinkedSt); err != nil {
+		t.Fatal(err)
+	}
+	unlinked := lookup("unlinked.txt", &unlinkedSt)
+	if errno := root.(*ageFSNode).Unlink(ctx, "unlinked.txt"); errno != 0 {
+		t.Fatal(errno)
+	}
+	if got := lookup("other.txt", &unlinkedSt); got == unlinked {
+		t.Errorf("new file reusing an unlinked inode number got its inode %v", got)
+	}
+
+	// Forgotten inodes are dropped from the maps.
+	rootInode.RmAllChildren()
+	r.inoMu.Lock()
+	r.inoSweepAt = 0
+	r.sweepInos()
+	n := len(r.inoAliases) + len(r.inoDisplaced)
+	r.inoMu.Unlock()
+	if n != 0 {
+		t.Errorf("entries left for forgotten inodes, got=%d", n)
+	}
+}
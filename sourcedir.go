@@ -0,0 +1,169 @@
+package agefs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"filippo.io/age"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hnakamur/agefs/internal/ageutil"
+	"go.uber.org/multierr"
+)
+
+// SourceDir gives access to the files in a source directory without
+// mounting it. Files are encrypted and decrypted following the same policy
+// as the mount, so that files written through a SourceDir cannot be told
+// from ones written through the mount.
+type SourceDir struct {
+	root *ageFSRoot
+}
+
+// NewSourceDir returns a SourceDir for rootPath. The arguments are the same
+// as for [NewRoot].
+func NewSourceDir(rootPath string, identities []age.Identity, shouldEncrypt ShouldEncryptFunc, opts ...RootOption) (*SourceDir, error) {
+	recipients, err := ageutil.IdentitiesToRecipients(identities)
+	if err != nil {
+		return nil, err
+	}
+
+	root := &ageFSRoot{
+		LoopbackRoot: fs.LoopbackRoot{
+			Path: rootPath,
+		},
+		identities: identities,
+		recipients: recipients,
+	}
+	for _, opt := range opts {
+		opt(root)
+	}
+	if _, err := os.Lstat(filepath.Join(rootPath, nameKeyFilename)); err == nil || root.encryptNames {
+		return nil, fmt.Errorf("encrypted file names are not supported: %s", rootPath)
+	}
+	if root.metadataStore, err = openMetadataStore(rootPath, root.metadataBackend); err != nil {
+		return nil, err
+	}
+	if shouldEncrypt == nil {
+		if shouldEncrypt, err = ReadIgnoreFiles(rootPath); err != nil {
+			return nil, err
+		}
+	}
+	root.policy.Store(&shouldEncrypt)
+	return &SourceDir{root: root}, nil
+}
+
+// ReadFile returns the plaintext of the file at relPath, which is relative
+// to the source directory.
+func (d *SourceDir) ReadFile(relPath string) (data []byte, err error) {
+	path, err := d.path(relPath)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = multierr.Append(err, f.Close())
+	}()
+
+	return d.root.readContent(f, relPath)
+}
+
+// WriteFile writes data to the file at relPath, which is relative to the
+// source directory, encrypting it if the policy says so. An existing file is
+// replaced atomically keeping its mode, owner and extended attributes as on
+// the mount, and a new file is created with perm.
+func (d *SourceDir) WriteFile(relPath string, data []byte, perm os.FileMode) (err error) {
+	path, err := d.path(relPath)
+	if err != nil {
+		return err
+	}
+	write := func(f *os.File) error {
+		return d.root.writeContent(f, relPath, data)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		return createFile(path, perm, write)
+	}
+	defer func() {
+		err = multierr.Append(err, f.Close())
+	}()
+
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return err
+	}
+	if st.Nlink > 1 {
+		// Replacing the file would detach it from its other hard links.
+		return overwriteFile(path, write)
+	}
+	_, err = d.root.replaceFile(path, int(f.Fd()), &st, write)
+	return err
+}
+
+// path returns the path of the file at relPath in the underlying file
+// system. relPath must not refer outside of the source directory, and none
+// of its components may be a symbolic link, which could lead out of it.
+func (d *SourceDir) path(relPath string) (string, error) {
+	p := filepath.Clean(relPath)
+	if filepath.IsAbs(p) || p == ".." || strings.HasPrefix(p, ".."+string(os.PathSeparator)) {
+		return "", fmt.Errorf("path is outside of the source directory: %s", relPath)
+	}
+
+	path := d.root.Path
+	for _, name := range strings.Split(p, string(os.PathSeparator)) {
+		path = filepath.Join(path, name)
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			// The rest of the path does not exist either.
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("path has a symbolic link: %s", relPath)
+		}
+	}
+	return filepath.Join(d.root.Path, p), nil
+}
+
+func createFile(path string, perm os.FileMode, write func(f *os.File) error) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = multierr.Append(err, f.Close())
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	if err := write(f); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func overwriteFile(path string, write func(f *os.File) error) (err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = multierr.Append(err, f.Close())
+	}()
+
+	if err := write(f); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,90 @@
+package agefs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestSourceDir(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shouldEncrypt, err := readIgnorePatterns(strings.NewReader("*.pub\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	d, err := NewSourceDir(dir, []age.Identity{id}, shouldEncrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		relPath   string
+		encrypted bool
+	}{
+		{relPath: "secret.txt", encrypted: true},
+		{relPath: "id.pub", encrypted: false},
+	} {
+		for _, content := range []string{"first", "second content"} {
+			if err := d.WriteFile(tc.relPath, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			raw, err := os.ReadFile(filepath.Join(dir, tc.relPath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(raw) != content; got != tc.encrypted {
+				t.Errorf("encrypted mismatch for %s, got=%v, want=%v", tc.relPath, got, tc.encrypted)
+			}
+			if tc.encrypted {
+				sz, ok, err := d.root.getXattrDecryptedSize(filepath.Join(dir, tc.relPath))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok || sz != uint64(len(content)) {
+					t.Errorf("decrypted size mismatch for %s, got=%d, want=%d", tc.relPath, sz, len(content))
+				}
+			}
+
+			got, err := d.ReadFile(tc.relPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != content {
+				t.Errorf("content mismatch for %s, got=%q, want=%q", tc.relPath, got, content)
+			}
+		}
+	}
+
+	if _, err := d.ReadFile("../secret.txt"); err == nil {
+		t.Error("got no error for path outside of the source directory")
+	}
+
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("outside"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("secret.txt", filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	for _, relPath := range []string{"out/secret.txt", "link.txt"} {
+		if _, err := d.ReadFile(relPath); err == nil {
+			t.Errorf("got no error for reading %s through a symbolic link", relPath)
+		}
+	}
+	if err := d.WriteFile("out/new.txt", []byte("new"), 0600); err == nil {
+		t.Error("got no error for writing through a symbolic link")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("file written outside of the source directory, err=%v", err)
+	}
+}